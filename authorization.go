@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	kubewarden "github.com/kubewarden/policy-sdk-go"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/kubernetes"
+	kubewarden_protocol "github.com/kubewarden/policy-sdk-go/protocol"
+)
+
+const (
+	// RancherManageNamespacesVerb is the verb Rancher Manager uses to grant
+	// the management of the Namespaces of a Project
+	RancherManageNamespacesVerb = "manage-namespaces"
+
+	// RancherManagementGroup is the API group of the Rancher Manager resources
+	RancherManagementGroup = "management.cattle.io"
+
+	// RancherProjectsResource is the resource name of the Rancher Projects
+	RancherProjectsResource = "projects"
+
+	// RancherSystemProjectLabel is the label Rancher Manager sets on the
+	// System Project of each cluster
+	RancherSystemProjectLabel = "authz.management.cattle.io/system-project"
+)
+
+// canI checks whether the user is allowed to perform the given action.
+//
+// Note: the `can_i` host capability doesn't support the name of the
+// resource, hence the check cannot be scoped to a single resource.
+func canI(userInfo *kubewarden_protocol.UserInfo, attributes ResourceAttributes) (kubernetes.SubjectAccessReviewStatus, error) {
+	return kubernetes.CanI(&host, kubernetes.SubjectAccessReviewRequest{
+		APIVersion: "authorization.k8s.io/v1",
+		Kind:       "SubjectAccessReview",
+		Spec: kubernetes.SubjectAccessReviewSpec{
+			ResourceAttributes: kubernetes.ResourceAttributes{
+				Namespace: attributes.Namespace,
+				Verb:      attributes.Verb,
+				Group:     attributes.Group,
+				Resource:  attributes.Resource,
+			},
+			User:   userInfo.Username,
+			Groups: userInfo.Groups,
+		},
+	})
+}
+
+// checkProjectPermissions ensures the user is allowed to manage the
+// Namespaces of the given Project. The check is not scoped to the Project:
+// the verb must be granted on all the Projects of the cluster Namespace.
+func checkProjectPermissions(userInfo *kubewarden_protocol.UserInfo, projectNamespace, projectID string) *LookupError {
+	status, err := canI(userInfo, ResourceAttributes{
+		Namespace: projectNamespace,
+		Verb:      RancherManageNamespacesVerb,
+		Group:     RancherManagementGroup,
+		Resource:  RancherProjectsResource,
+	})
+	if err != nil {
+		return &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Error checking the permissions of the user: %v", err)),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	if !status.Allowed {
+		return &LookupError{
+			Message: kubewarden.Message(fmt.Sprintf(
+				"User %s is not allowed to add namespaces to Project %s:%s: the '%s' verb on %s.%s is required",
+				userInfo.Username, projectNamespace, projectID,
+				RancherManageNamespacesVerb, RancherProjectsResource, RancherManagementGroup)),
+			StatusCode: kubewarden.Code(403),
+		}
+	}
+
+	return nil
+}
+
+// isAuthorized returns true when the user is allowed to perform the
+// PrivilegedOperation
+func isAuthorized(userInfo *kubewarden_protocol.UserInfo, operation *PrivilegedOperation) (bool, error) {
+	for _, user := range operation.Users {
+		if user == userInfo.Username {
+			return true, nil
+		}
+	}
+
+	for _, group := range operation.Groups {
+		for _, userGroup := range userInfo.Groups {
+			if group == userGroup {
+				return true, nil
+			}
+		}
+	}
+
+	if operation.ResourceAttributes == nil {
+		return false, nil
+	}
+
+	status, err := canI(userInfo, *operation.ResourceAttributes)
+	if err != nil {
+		return false, err
+	}
+
+	return status.Allowed, nil
+}
+
+// describePermission returns a human readable description of the
+// permission required to perform the PrivilegedOperation
+func describePermission(operation *PrivilegedOperation) string {
+	if operation.ResourceAttributes == nil {
+		return "the user is not part of the allowed users and groups"
+	}
+
+	attributes := operation.ResourceAttributes
+	resource := attributes.Resource
+	if attributes.Group != "" {
+		resource = fmt.Sprintf("%s.%s", attributes.Resource, attributes.Group)
+	}
+	if attributes.Namespace != "" {
+		resource = fmt.Sprintf("%s inside of namespace %s", resource, attributes.Namespace)
+	}
+
+	return fmt.Sprintf("the '%s' verb on %s is required", attributes.Verb, resource)
+}
+
+// checkPrivilegedOperation ensures the user is allowed to perform the
+// PrivilegedOperation. `description` describes the operation inside of the
+// messages shown to the user.
+func checkPrivilegedOperation(userInfo *kubewarden_protocol.UserInfo, operation *PrivilegedOperation, description string) *LookupError {
+	authorized, err := isAuthorized(userInfo, operation)
+	if err != nil {
+		return &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Error checking the permissions of the user: %v", err)),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	if !authorized {
+		return &LookupError{
+			Message: kubewarden.Message(fmt.Sprintf("User %s is not allowed to %s: %s",
+				userInfo.Username, description, describePermission(operation))),
+			StatusCode: kubewarden.Code(403),
+		}
+	}
+
+	return nil
+}
+
+// systemServiceAccountNamespaces are the Namespaces holding the service
+// accounts of the control plane and of Rancher
+var systemServiceAccountNamespaces = []string{"kube-system", "cattle-system"}
+
+// systemUsers are the users of the control plane components
+var systemUsers = []string{"system:kube-controller-manager", "system:kube-scheduler", "system:apiserver"}
+
+// rancherServiceAccountPrefix is the prefix of the service accounts used by
+// Rancher Manager to act on behalf of its users
+const rancherServiceAccountPrefix = "system:serviceaccount:cattle-system:"
+
+// isRancherPrincipal returns true when the request is issued by Rancher
+// Manager, the only one trusted to set the `field.cattle.io/creatorId`
+// annotation
+func isRancherPrincipal(userInfo *kubewarden_protocol.UserInfo) bool {
+	return strings.HasPrefix(userInfo.Username, rancherServiceAccountPrefix)
+}
+
+// isSystemPrincipal returns true when the user is one of the Kubernetes
+// system principals: the control plane components, the service accounts of
+// the `kube-system` and `cattle-system` Namespaces and the members of the
+// `system:masters` group. The service accounts of other Namespaces are not
+// system principals, they could be owned by the tenants.
+func isSystemPrincipal(userInfo *kubewarden_protocol.UserInfo) bool {
+	for _, user := range systemUsers {
+		if userInfo.Username == user {
+			return true
+		}
+	}
+
+	for _, namespace := range systemServiceAccountNamespaces {
+		if strings.HasPrefix(userInfo.Username, fmt.Sprintf("system:serviceaccount:%s:", namespace)) {
+			return true
+		}
+	}
+
+	for _, group := range userInfo.Groups {
+		if group == "system:masters" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkSystemProjectAccess ensures only system principals, or the ones
+// allowed by the settings, add Namespaces to the Rancher System Project
+func checkSystemProjectAccess(settings *Settings, userInfo *kubewarden_protocol.UserInfo, project *Project, projectKey string) *LookupError {
+	if project.Metadata == nil || project.Metadata.Labels[RancherSystemProjectLabel] != "true" {
+		return nil
+	}
+
+	if isSystemPrincipal(userInfo) {
+		return nil
+	}
+
+	description := fmt.Sprintf("add namespaces to the System Project %s", projectKey)
+	if settings.SystemProjectPrincipals == nil {
+		return &LookupError{
+			Message: kubewarden.Message(fmt.Sprintf("User %s is not allowed to %s: only system principals can do that",
+				userInfo.Username, description)),
+			StatusCode: kubewarden.Code(403),
+		}
+	}
+
+	return checkPrivilegedOperation(userInfo, settings.SystemProjectPrincipals, description)
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	metav1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+	kubewarden "github.com/kubewarden/policy-sdk-go"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/kubernetes"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/mocks"
+	kubewarden_protocol "github.com/kubewarden/policy-sdk-go/protocol"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestCheckProjectPermissions(t *testing.T) {
+	cases := []struct {
+		desc          string
+		status        kubernetes.SubjectAccessReviewStatus
+		responseError error
+		expectError   *LookupError
+	}{
+		{
+			"allowed",
+			kubernetes.SubjectAccessReviewStatus{Allowed: true},
+			nil,
+			nil,
+		},
+		{
+			"not allowed",
+			kubernetes.SubjectAccessReviewStatus{Allowed: false, Reason: "no RBAC policy matched"},
+			nil,
+			&LookupError{StatusCode: kubewarden.Code(403)},
+		},
+		{
+			"waPC host error",
+			kubernetes.SubjectAccessReviewStatus{},
+			fmt.Errorf("something went wrong with waPC host"),
+			&LookupError{StatusCode: kubewarden.Code(500)},
+		},
+	}
+
+	for _, tc := range cases {
+		userInfo := kubewarden_protocol.UserInfo{
+			Username: "alice",
+			Groups:   []string{"developers", "system:authenticated"},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		mockCanI(t, mockWapcClient, &userInfo, ResourceAttributes{
+			Namespace: "local",
+			Verb:      RancherManageNamespacesVerb,
+			Group:     RancherManagementGroup,
+			Resource:  RancherProjectsResource,
+		}, tc.status, tc.responseError)
+		host.Client = mockWapcClient
+
+		lookupErr := checkProjectPermissions(&userInfo, "local", "p-finance")
+
+		if lookupErr == nil && tc.expectError != nil {
+			t.Errorf("%s - didn't get an error as expected", tc.desc)
+		}
+
+		if lookupErr != nil && tc.expectError == nil {
+			t.Errorf("%s - was not expected to fail with error: %v", tc.desc, lookupErr)
+		}
+
+		if lookupErr != nil && tc.expectError != nil {
+			if lookupErr.StatusCode != tc.expectError.StatusCode {
+				t.Errorf("%s - got the wrong status code. Expecting %d, got %d instead", tc.desc, tc.expectError.StatusCode, lookupErr.StatusCode)
+			}
+		}
+	}
+}
+
+func TestCanIPayload(t *testing.T) {
+	userInfo := kubewarden_protocol.UserInfo{
+		Username: "alice",
+		Groups:   []string{"developers"},
+	}
+
+	mockWapcClient := &mocks.MockWapcClient{}
+	mockWapcClient.On("HostCall", "kubewarden", "kubernetes", "can_i", mock.Anything).Return([]byte(`{"allowed":true}`), nil)
+	host.Client = mockWapcClient
+
+	if lookupErr := checkProjectPermissions(&userInfo, "local", "p-finance"); lookupErr != nil {
+		t.Fatalf("unexpected error: %v", lookupErr)
+	}
+
+	expected := `{"apiVersion":"authorization.k8s.io/v1","kind":"SubjectAccessReview",` +
+		`"spec":{"resourceAttributes":{"namespace":"local","verb":"manage-namespaces","group":"management.cattle.io","resource":"projects"},` +
+		`"user":"alice","groups":["developers"]},"disable_cache":false}`
+	if payload := string(mockWapcClient.Calls[0].Arguments.Get(3).([]byte)); payload != expected {
+		t.Errorf("wrong can_i payload. Got '%s' instead of '%s'", payload, expected)
+	}
+}
+
+// mockCanI registers the response of the `can_i` host callback
+func mockCanI(t *testing.T, mockWapcClient *mocks.MockWapcClient, userInfo *kubewarden_protocol.UserInfo, attributes ResourceAttributes, status kubernetes.SubjectAccessReviewStatus, responseError error) {
+	t.Helper()
+
+	request, err := json.Marshal(&kubernetes.SubjectAccessReviewRequest{
+		APIVersion: "authorization.k8s.io/v1",
+		Kind:       "SubjectAccessReview",
+		Spec: kubernetes.SubjectAccessReviewSpec{
+			ResourceAttributes: kubernetes.ResourceAttributes{
+				Namespace: attributes.Namespace,
+				Verb:      attributes.Verb,
+				Group:     attributes.Group,
+				Resource:  attributes.Resource,
+			},
+			User:   userInfo.Username,
+			Groups: userInfo.Groups,
+		},
+	})
+	if err != nil {
+		t.Fatalf("cannot marshall request: %v", err)
+	}
+
+	wapcResponse, err := json.Marshal(&status)
+	if err != nil {
+		t.Fatalf("cannot marshall SubjectAccessReviewStatus: %v", err)
+	}
+
+	mockWapcClient.On("HostCall", "kubewarden", "kubernetes", "can_i", request).Return(wapcResponse, responseError)
+}
+
+func TestCheckSystemProjectAccess(t *testing.T) {
+	cases := []struct {
+		desc          string
+		settings      Settings
+		userInfo      kubewarden_protocol.UserInfo
+		projectLabels map[string]string
+		expectError   bool
+	}{
+		{
+			"not the system project",
+			Settings{},
+			kubewarden_protocol.UserInfo{Username: "alice"},
+			map[string]string{RancherSystemProjectLabel: "false"},
+			false,
+		},
+		{
+			"service account",
+			Settings{},
+			kubewarden_protocol.UserInfo{Username: "system:serviceaccount:cattle-system:rancher"},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			false,
+		},
+		{
+			"kube-system service account",
+			Settings{},
+			kubewarden_protocol.UserInfo{Username: "system:serviceaccount:kube-system:namespace-controller"},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			false,
+		},
+		{
+			"control plane component",
+			Settings{},
+			kubewarden_protocol.UserInfo{Username: "system:kube-controller-manager"},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			false,
+		},
+		{
+			"tenant service account",
+			Settings{},
+			kubewarden_protocol.UserInfo{Username: "system:serviceaccount:team-a:deployer", Groups: []string{"system:serviceaccounts"}},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			true,
+		},
+		{
+			"service account of a namespace prefixed like a system one",
+			Settings{},
+			kubewarden_protocol.UserInfo{Username: "system:serviceaccount:kube-system-fake:deployer"},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			true,
+		},
+		{
+			"anonymous user",
+			Settings{},
+			kubewarden_protocol.UserInfo{Username: "system:anonymous", Groups: []string{"system:unauthenticated"}},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			true,
+		},
+		{
+			"cluster admin",
+			Settings{},
+			kubewarden_protocol.UserInfo{Username: "kubernetes-admin", Groups: []string{"system:masters"}},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			false,
+		},
+		{
+			"regular user",
+			Settings{},
+			kubewarden_protocol.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			true,
+		},
+		{
+			"regular user allowed by the settings",
+			Settings{SystemProjectPrincipals: &PrivilegedOperation{Users: []string{"alice"}}},
+			kubewarden_protocol.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			false,
+		},
+		{
+			"regular user not allowed by the settings",
+			Settings{SystemProjectPrincipals: &PrivilegedOperation{Groups: []string{"platform-admins"}}},
+			kubewarden_protocol.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}},
+			map[string]string{RancherSystemProjectLabel: "true"},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:      "p-abcde",
+				Namespace: "local",
+				Labels:    tc.projectLabels,
+			},
+			Spec: &ProjectSpec{DisplayName: "System"},
+		}
+
+		// no host capability is expected to be used
+		host.Client = &mocks.MockWapcClient{}
+
+		lookupErr := checkSystemProjectAccess(&tc.settings, &tc.userInfo, &project, "local:p-abcde")
+		if tc.expectError && lookupErr == nil {
+			t.Errorf("%s - was expecting an error", tc.desc)
+		}
+		if !tc.expectError && lookupErr != nil {
+			t.Errorf("%s - unexpected error: %v", tc.desc, lookupErr)
+		}
+	}
+}
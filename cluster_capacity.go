@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
+	kubewarden "github.com/kubewarden/policy-sdk-go"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/kubernetes"
+	"github.com/kubewarden/rancher-project-quotas-namespace-validator/resource"
+)
+
+// clusterCapacityResources maps the Project resources checked against the
+// capacity of the cluster to the matching allocatable resource of the Nodes
+var clusterCapacityResources = map[string]string{
+	"requestsCpu":    "cpu",
+	"limitsCpu":      "cpu",
+	"requestsMemory": "memory",
+	"limitsMemory":   "memory",
+}
+
+// ClusterCapacityExceededError is a custom error raised when the quotas of
+// all the Projects of the cluster exceed the allocatable resources of the Nodes
+type ClusterCapacityExceededError struct {
+	projects string
+	capacity string
+}
+
+func (e *ClusterCapacityExceededError) Error() string {
+	return fmt.Sprintf("Project limits exceed the cluster capacity: projects %s, cluster capacity %s", e.projects, e.capacity)
+}
+
+// clusterCapacityFields returns the resources among the given ones that
+// are checked against the capacity of the cluster
+func clusterCapacityFields(fields []resourceQuotaField) []resourceQuotaField {
+	capacityFields := []resourceQuotaField{}
+	for _, field := range fields {
+		if _, found := clusterCapacityResources[field.Key]; found {
+			capacityFields = append(capacityFields, field)
+		}
+	}
+
+	return capacityFields
+}
+
+// listNodes returns all the Nodes of the cluster
+func listNodes() ([]*corev1.Node, *LookupError) {
+	listNodesReq := kubernetes.ListAllResourcesRequest{
+		APIVersion: "v1",
+		Kind:       "Node",
+	}
+
+	nodesRaw, err := kubernetes.ListResources(&host, listNodesReq)
+	if err != nil {
+		return nil, &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Error listing the Nodes: %v", err)),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	nodeList := corev1.NodeList{}
+	if err := json.Unmarshal(nodesRaw, &nodeList); err != nil {
+		return nil, &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Cannot decode NodeList object: %s", err.Error())),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	return nodeList.Items, nil
+}
+
+// ProjectList is a list of Rancher Projects
+type ProjectList struct {
+	Items []*Project `json:"items"`
+}
+
+// listClusterProjects returns the Projects of the given cluster. Rancher
+// keeps them inside of the Namespace named after the cluster.
+func listClusterProjects(clusterName string) ([]*Project, *LookupError) {
+	listProjectsReq := kubernetes.ListResourcesByNamespaceRequest{
+		APIVersion: RancherProjectAPIVersion,
+		Kind:       RancherProjectKind,
+		Namespace:  clusterName,
+	}
+
+	projectsRaw, err := kubernetes.ListResourcesByNamespace(&host, listProjectsReq)
+	if err != nil {
+		return nil, &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Error listing the Projects of the cluster: %v", err)),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	projectList := ProjectList{}
+	if err := json.Unmarshal(projectsRaw, &projectList); err != nil {
+		return nil, &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Cannot decode ProjectList object: %s", err.Error())),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	return projectList.Items, nil
+}
+
+// validateClusterCapacity ensures the sum of the limits of all the Projects
+// of the cluster fits inside of the allocatable resources of the Nodes,
+// multiplied by the overcommit factor. The given Project replaces its stored
+// version. Only the given resources are checked.
+func validateClusterCapacity(project *Project, projects []*Project, nodes []*corev1.Node, fields []resourceQuotaField, overcommitFactor float64) error {
+	capacities := map[string]resource.Quantity{}
+	for _, node := range nodes {
+		if node == nil || node.Status == nil {
+			continue
+		}
+
+		for _, nodeResource := range []string{"cpu", "memory"} {
+			allocatable, found := node.Status.Allocatable[nodeResource]
+			if !found || allocatable == nil {
+				continue
+			}
+
+			allocatableQuantity, err := resource.ParseQuantity(string(*allocatable))
+			if err != nil {
+				nodeName := ""
+				if node.Metadata != nil {
+					nodeName = node.Metadata.Name
+				}
+				return &QuantityParseError{
+					Message: fmt.Sprintf("Cannot convert allocatable %s of node %s to quantity", nodeResource, nodeName),
+					Err:     err,
+				}
+			}
+
+			capacity := capacities[nodeResource]
+			capacity.Add(allocatableQuantity)
+			capacities[nodeResource] = capacity
+		}
+	}
+
+	if overcommitFactor == 0 {
+		overcommitFactor = 1
+	}
+
+	allProjects := []*Project{project}
+	for _, p := range projects {
+		if p == nil || p.Metadata == nil || p.Metadata.Name == project.Metadata.Name {
+			continue
+		}
+		allProjects = append(allProjects, p)
+	}
+
+	errors := []error{}
+
+	for _, field := range fields {
+		total := resource.Quantity{}
+		for _, p := range allProjects {
+			if p.Spec == nil || p.Spec.ResourceQuota == nil {
+				continue
+			}
+
+			limit := *field.Value(&p.Spec.ResourceQuota.Limit)
+			if limit == "" {
+				continue
+			}
+
+			limitQuantity, err := resource.ParseQuantity(limit)
+			if err != nil {
+				errors = append(errors, fmt.Errorf("%s limit: %w", field.Name, &QuantityParseError{
+					Message: fmt.Sprintf("Cannot convert limit of project %s to quantity", p.Metadata.Name),
+					Err:     err,
+				}))
+				continue
+			}
+			total.Add(limitQuantity)
+		}
+
+		capacity := capacities[clusterCapacityResources[field.Key]]
+		if overcommitFactor != 1 {
+			capacity = scaleQuantity(capacity, overcommitFactor)
+		}
+
+		if total.Cmp(capacity) > 0 {
+			errors = append(errors, fmt.Errorf("%s limit: %w", field.Name, &ClusterCapacityExceededError{
+				projects: total.String(),
+				capacity: capacity.String(),
+			}))
+		}
+	}
+
+	return joinErrors(errors)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
+	k8sresource "github.com/kubewarden/k8s-objects/apimachinery/pkg/api/resource"
+	metav1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/kubernetes"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/mocks"
+)
+
+// buildNode returns a Node with the given allocatable resources
+func buildNode(name, cpu, memory string) *corev1.Node {
+	cpuQuantity := k8sresource.Quantity(cpu)
+	memoryQuantity := k8sresource.Quantity(memory)
+
+	return &corev1.Node{
+		Metadata: &metav1.ObjectMeta{Name: name},
+		Status: &corev1.NodeStatus{
+			Allocatable: map[string]*k8sresource.Quantity{
+				"cpu":    &cpuQuantity,
+				"memory": &memoryQuantity,
+			},
+		},
+	}
+}
+
+// buildProject returns a Project of the `local` cluster with the given limits,
+// used also as namespace default quota
+func buildProject(name string, limit ResourceQuotaLimit) *Project {
+	return &Project{
+		APIVersion: RancherProjectAPIVersion,
+		Kind:       RancherProjectKind,
+		Metadata: &metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "local",
+		},
+		Spec: &ProjectSpec{
+			ClusterName:   "local",
+			ResourceQuota: &ProjectResourceQuota{Limit: limit},
+			NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+				Limit: limit,
+			},
+		},
+	}
+}
+
+func TestValidateClusterCapacity(t *testing.T) {
+	nodes := []*corev1.Node{
+		buildNode("one", "4", "8Gi"),
+		buildNode("two", "3500m", "8Gi"),
+	}
+	projects := []*Project{
+		buildProject("p-one", ResourceQuotaLimit{RequestsCPU: "4", LimitsMemory: "8Gi"}),
+		buildProject("p-two", ResourceQuotaLimit{RequestsCPU: "2"}),
+	}
+
+	cases := []struct {
+		desc             string
+		project          *Project
+		overcommitFactor float64
+		expectError      bool
+	}{
+		{
+			"fits",
+			buildProject("p-new", ResourceQuotaLimit{RequestsCPU: "1500m", LimitsMemory: "8Gi"}),
+			0,
+			false,
+		},
+		{
+			"exceeds the cpu",
+			buildProject("p-new", ResourceQuotaLimit{RequestsCPU: "2"}),
+			0,
+			true,
+		},
+		{
+			"exceeds the memory",
+			buildProject("p-new", ResourceQuotaLimit{LimitsMemory: "9Gi"}),
+			0,
+			true,
+		},
+		{
+			"fits thanks to the overcommit factor",
+			buildProject("p-new", ResourceQuotaLimit{RequestsCPU: "2", LimitsMemory: "24Gi"}),
+			2,
+			false,
+		},
+		{
+			"update replaces the stored project",
+			buildProject("p-one", ResourceQuotaLimit{RequestsCPU: "5500m"}),
+			0,
+			false,
+		},
+		{
+			"update exceeds the cpu",
+			buildProject("p-two", ResourceQuotaLimit{RequestsCPU: "4"}),
+			0,
+			true,
+		},
+		{
+			"malformed limit",
+			buildProject("p-new", ResourceQuotaLimit{RequestsCPU: "lots"}),
+			0,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		fields := clusterCapacityFields(changedProjectLimits(&Project{}, tc.project))
+		err := validateClusterCapacity(tc.project, projects, nodes, fields, tc.overcommitFactor)
+		if !tc.expectError && err != nil {
+			t.Errorf("%s: got an unexpected error: %v", tc.desc, err)
+		}
+		if tc.expectError && err == nil {
+			t.Errorf("%s: was expecting an error", tc.desc)
+		}
+	}
+}
+
+func TestClusterCapacityProjectValidation(t *testing.T) {
+	cases := []struct {
+		desc        string
+		project     *Project
+		expectLists bool
+		isValid     bool
+	}{
+		{
+			"fits",
+			buildProject("p-new", ResourceQuotaLimit{RequestsCPU: "1"}),
+			true,
+			true,
+		},
+		{
+			"exceeds the cluster capacity",
+			buildProject("p-new", ResourceQuotaLimit{RequestsCPU: "3"}),
+			true,
+			false,
+		},
+		{
+			"resources not checked against the cluster capacity",
+			buildProject("p-new", ResourceQuotaLimit{Pods: "100"}),
+			false,
+			true,
+		},
+	}
+
+	settings := Settings{
+		ClusterName:     "local",
+		ClusterCapacity: &ClusterCapacityCheck{},
+	}
+
+	for _, tc := range cases {
+		mockWapcClient := &mocks.MockWapcClient{}
+		if tc.expectLists {
+			mockNodeList(t, mockWapcClient, []*corev1.Node{buildNode("one", "4", "8Gi")})
+			mockProjectList(t, mockWapcClient, "local", []*Project{
+				buildProject("p-one", ResourceQuotaLimit{RequestsCPU: "2"}),
+			})
+		}
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "CREATE", projectKind, tc.project, nil, nil, &settings)
+		if response.Accepted != tc.isValid {
+			message := "no message set"
+			if response.Message != nil {
+				message = *response.Message
+			}
+			t.Errorf("%s - expected accepted to be %v, got %v: %s", tc.desc, tc.isValid, response.Accepted, message)
+		}
+		mockWapcClient.AssertExpectations(t)
+	}
+}
+
+// mockNodeList registers the response of the `list_resources_all` host
+// callback used to find the Nodes of the cluster
+func mockNodeList(t *testing.T, mockWapcClient *mocks.MockWapcClient, nodes []*corev1.Node) {
+	t.Helper()
+
+	request, err := json.Marshal(&kubernetes.ListAllResourcesRequest{
+		APIVersion: "v1",
+		Kind:       "Node",
+	})
+	if err != nil {
+		t.Fatalf("cannot marshall request: %v", err)
+	}
+
+	wapcResponse, err := json.Marshal(&corev1.NodeList{Items: nodes})
+	if err != nil {
+		t.Fatalf("cannot marshall NodeList: %v", err)
+	}
+
+	mockWapcClient.On("HostCall", "kubewarden", "kubernetes", "list_resources_all", request).Return(wapcResponse, nil)
+}
+
+// mockProjectList registers the response of the `list_resources_by_namespace`
+// host callback used to find the Projects of the given cluster
+func mockProjectList(t *testing.T, mockWapcClient *mocks.MockWapcClient, clusterName string, projects []*Project) {
+	t.Helper()
+
+	request, err := json.Marshal(&kubernetes.ListResourcesByNamespaceRequest{
+		APIVersion: RancherProjectAPIVersion,
+		Kind:       RancherProjectKind,
+		Namespace:  clusterName,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshall request: %v", err)
+	}
+
+	wapcResponse, err := json.Marshal(&ProjectList{Items: projects})
+	if err != nil {
+		t.Fatalf("cannot marshall ProjectList: %v", err)
+	}
+
+	mockWapcClient.On("HostCall", "kubewarden", "kubernetes", "list_resources_by_namespace", request).Return(wapcResponse, nil)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"encoding/json"
+
+	kubewarden "github.com/kubewarden/policy-sdk-go"
+)
+
+var logWriter = &kubewarden.KubewardenLogWriter{}
+
+// logWarning sends a warning message to the host. The message is then
+// shown inside of the logs of the policy server.
+func logWarning(message string) {
+	event, err := json.Marshal(&LogEvent{
+		Level:   "warning",
+		Message: message,
+	})
+	if err != nil {
+		return
+	}
+
+	_, _ = logWriter.Write(append(event, '\n'))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+
+	meta_v1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+	kubewarden_protocol "github.com/kubewarden/policy-sdk-go/protocol"
+)
+
+// checkNamespaceUpdate ensures the user is allowed to perform the changes
+// done to an existing Namespace
+func checkNamespaceUpdate(settings *Settings, userInfo *kubewarden_protocol.UserInfo, oldMetadata, newMetadata *meta_v1.ObjectMeta) *LookupError {
+	oldProjectID, oldFound := oldMetadata.Annotations[RancherProjectIDAnnotation]
+	_, newFound := newMetadata.Annotations[RancherProjectIDAnnotation]
+
+	if settings.ProjectIDRemoval != nil && oldFound && !newFound {
+		description := fmt.Sprintf("remove the %s annotation from Namespace %s, taking it out of Project %s",
+			RancherProjectIDAnnotation, newMetadata.Name, oldProjectID)
+		if lookupError := checkPrivilegedOperation(userInfo, settings.ProjectIDRemoval, description); lookupError != nil {
+			return lookupError
+		}
+	}
+
+	oldQuota, oldQuotaFound := oldMetadata.Annotations[RancherResourceQuotaAnnotation]
+	newQuota, newQuotaFound := newMetadata.Annotations[RancherResourceQuotaAnnotation]
+
+	if settings.ResourceQuotaChange != nil && (oldQuotaFound != newQuotaFound || oldQuota != newQuota) {
+		description := fmt.Sprintf("change the %s annotation of Namespace %s",
+			RancherResourceQuotaAnnotation, newMetadata.Name)
+		if lookupError := checkPrivilegedOperation(userInfo, settings.ResourceQuotaChange, description); lookupError != nil {
+			return lookupError
+		}
+	}
+
+	return nil
+}
+
+// projectAssociationChanged returns true when the Namespace has been moved
+// to a different Project. The Projects are compared through their
+// `<cluster>:<project>` identifiers. The label is part of the association
+// only when the Project is resolved from it.
+func projectAssociationChanged(settings *Settings, oldMetadata, newMetadata *meta_v1.ObjectMeta) bool {
+	oldKey, oldFound := namespaceProjectKey(settings, oldMetadata)
+	newKey, newFound := namespaceProjectKey(settings, newMetadata)
+
+	return oldFound != newFound || oldKey != newKey
+}
+
+// projectIDLabelChanged returns true when the `field.cattle.io/projectId`
+// label has been added, removed or changed
+func projectIDLabelChanged(oldMetadata, newMetadata *meta_v1.ObjectMeta) bool {
+	oldLabel, oldFound := oldMetadata.Labels[RancherProjectIDLabel]
+	newLabel, newFound := newMetadata.Labels[RancherProjectIDLabel]
+
+	return oldFound != newFound || oldLabel != newLabel
+}
+
+// namespaceProjectKey returns the `<cluster>:<project>` identifier of the
+// Project the Namespace belongs to. The label is taken into account only
+// when the Project is resolved from it. A malformed annotation is returned
+// as it is.
+func namespaceProjectKey(settings *Settings, metadata *meta_v1.ObjectMeta) (string, bool) {
+	if annotation, found := metadata.Annotations[RancherProjectIDAnnotation]; found {
+		projectNamespace, projectID, err := parseProjectIDAnnotation(annotation)
+		if err != nil {
+			return annotation, true
+		}
+		return fmt.Sprintf("%s:%s", projectNamespace, projectID), true
+	}
+
+	if label, found := metadata.Labels[RancherProjectIDLabel]; found && settings.ResolveProjectFromLabel {
+		return fmt.Sprintf("%s:%s", settings.ClusterName, label), true
+	}
+
+	return "", false
+}
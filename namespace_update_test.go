@@ -0,0 +1,399 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
+	metav1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/kubernetes"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/mocks"
+	kubewarden_protocol "github.com/kubewarden/policy-sdk-go/protocol"
+)
+
+func TestProjectIDRemoval(t *testing.T) {
+	sarAttributes := ResourceAttributes{
+		Verb:     "update",
+		Group:    RancherManagementGroup,
+		Resource: RancherProjectsResource,
+	}
+
+	cases := []struct {
+		desc      string
+		settings  Settings
+		sarStatus *kubernetes.SubjectAccessReviewStatus
+		isValid   bool
+	}{
+		{
+			"removal not restricted",
+			Settings{},
+			nil,
+			true,
+		},
+		{
+			"user is allowed",
+			Settings{ProjectIDRemoval: &PrivilegedOperation{Users: []string{"alice"}}},
+			nil,
+			true,
+		},
+		{
+			"group is allowed",
+			Settings{ProjectIDRemoval: &PrivilegedOperation{Groups: []string{"platform-admins"}}},
+			nil,
+			true,
+		},
+		{
+			"user is not allowed",
+			Settings{ProjectIDRemoval: &PrivilegedOperation{Users: []string{"bob"}}},
+			nil,
+			false,
+		},
+		{
+			"user passes the SubjectAccessReview",
+			Settings{ProjectIDRemoval: &PrivilegedOperation{ResourceAttributes: &sarAttributes}},
+			&kubernetes.SubjectAccessReviewStatus{Allowed: true},
+			true,
+		},
+		{
+			"user doesn't pass the SubjectAccessReview",
+			Settings{ProjectIDRemoval: &PrivilegedOperation{ResourceAttributes: &sarAttributes}},
+			&kubernetes.SubjectAccessReviewStatus{Allowed: false},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		oldNamespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name: "test-ns",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation: "local:p-abcde",
+				},
+			},
+		}
+		newNamespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name: "test-ns",
+			},
+		}
+		userInfo := kubewarden_protocol.UserInfo{
+			Username: "alice",
+			Groups:   []string{"platform-admins", "system:authenticated"},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		if tc.sarStatus != nil {
+			mockCanI(t, mockWapcClient, &userInfo, sarAttributes, *tc.sarStatus, nil)
+		}
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "UPDATE", namespaceKind, &newNamespace, &oldNamespace, &userInfo, &tc.settings)
+		if response.Accepted != tc.isValid {
+			message := "no message set"
+			if response.Message != nil {
+				message = *response.Message
+			}
+			t.Errorf("%s - expected accepted to be %v, got %v: %s", tc.desc, tc.isValid, response.Accepted, message)
+		}
+	}
+}
+
+func TestProjectAssociationChanged(t *testing.T) {
+	cases := []struct {
+		desc        string
+		settings    Settings
+		oldMetadata metav1.ObjectMeta
+		newMetadata metav1.ObjectMeta
+		changed     bool
+	}{
+		{
+			"nothing changed",
+			Settings{},
+			metav1.ObjectMeta{
+				Annotations: map[string]string{RancherProjectIDAnnotation: "local:p-abcde"},
+				Labels:      map[string]string{RancherProjectIDLabel: "p-abcde"},
+			},
+			metav1.ObjectMeta{
+				Annotations: map[string]string{RancherProjectIDAnnotation: "local:p-abcde", "team": "a-team"},
+				Labels:      map[string]string{RancherProjectIDLabel: "p-abcde"},
+			},
+			false,
+		},
+		{
+			"annotation changed",
+			Settings{},
+			metav1.ObjectMeta{
+				Annotations: map[string]string{RancherProjectIDAnnotation: "local:p-abcde"},
+			},
+			metav1.ObjectMeta{
+				Annotations: map[string]string{RancherProjectIDAnnotation: "local:p-fghij"},
+			},
+			true,
+		},
+		{
+			"annotation added",
+			Settings{},
+			metav1.ObjectMeta{},
+			metav1.ObjectMeta{
+				Annotations: map[string]string{RancherProjectIDAnnotation: "local:p-abcde"},
+			},
+			true,
+		},
+		{
+			"label added to an annotated namespace",
+			Settings{},
+			metav1.ObjectMeta{
+				Annotations: map[string]string{RancherProjectIDAnnotation: "local:p-abcde"},
+			},
+			metav1.ObjectMeta{
+				Annotations: map[string]string{RancherProjectIDAnnotation: "local:p-abcde"},
+				Labels:      map[string]string{RancherProjectIDLabel: "p-abcde"},
+			},
+			false,
+		},
+		{
+			"label changed",
+			Settings{},
+			metav1.ObjectMeta{
+				Labels: map[string]string{RancherProjectIDLabel: "p-abcde"},
+			},
+			metav1.ObjectMeta{
+				Labels: map[string]string{RancherProjectIDLabel: "p-fghij"},
+			},
+			false,
+		},
+		{
+			"malformed annotation added",
+			Settings{},
+			metav1.ObjectMeta{},
+			metav1.ObjectMeta{
+				Annotations: map[string]string{RancherProjectIDAnnotation: ""},
+			},
+			true,
+		},
+		{
+			"label changed, project resolved from the label",
+			Settings{ResolveProjectFromLabel: true, ClusterName: "local"},
+			metav1.ObjectMeta{
+				Labels: map[string]string{RancherProjectIDLabel: "p-abcde"},
+			},
+			metav1.ObjectMeta{
+				Labels: map[string]string{RancherProjectIDLabel: "p-fghij"},
+			},
+			true,
+		},
+	}
+	for _, tc := range cases {
+		if changed := projectAssociationChanged(&tc.settings, &tc.oldMetadata, &tc.newMetadata); changed != tc.changed {
+			t.Errorf("%s - expected %v, got %v", tc.desc, tc.changed, changed)
+		}
+	}
+}
+
+func TestProjectLabelAddedToAnnotatedNamespace(t *testing.T) {
+	oldNamespace := corev1.Namespace{
+		Metadata: &metav1.ObjectMeta{
+			Name: "test-ns",
+			Annotations: map[string]string{
+				RancherProjectIDAnnotation:     "local:p-abc",
+				RancherResourceQuotaAnnotation: `{"limit":{"pods":"10"}}`,
+			},
+		},
+	}
+	newNamespace := corev1.Namespace{
+		Metadata: &metav1.ObjectMeta{
+			Name:        "test-ns",
+			Annotations: oldNamespace.Metadata.Annotations,
+			Labels:      map[string]string{RancherProjectIDLabel: "p-abc"},
+		},
+	}
+
+	// the quota of the Namespace is already part of the used limit of the
+	// Project: the Namespace must not be validated again
+	host.Client = &mocks.MockWapcClient{}
+
+	userInfo := kubewarden_protocol.UserInfo{Username: "system:serviceaccount:cattle-system:rancher"}
+	response := runValidation(t, "UPDATE", namespaceKind, &newNamespace, &oldNamespace, &userInfo, &Settings{})
+	if !response.Accepted {
+		t.Errorf("expected the update to be accepted, got: %v", *response.Message)
+	}
+}
+
+func TestProjectLabelChange(t *testing.T) {
+	cases := []struct {
+		desc          string
+		settings      Settings
+		newLabels     map[string]string
+		isValid       bool
+		expectedLabel string
+	}{
+		{
+			"label changed to another Project",
+			Settings{},
+			map[string]string{RancherProjectIDLabel: "p-other"},
+			false,
+			"",
+		},
+		{
+			"label changed to another Project, label synced",
+			Settings{SyncProjectIDLabel: true},
+			map[string]string{RancherProjectIDLabel: "p-other"},
+			true,
+			"p-abc",
+		},
+		{
+			"label removed",
+			Settings{},
+			nil,
+			true,
+			"",
+		},
+	}
+
+	for _, tc := range cases {
+		oldNamespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name:        "test-ns",
+				Annotations: map[string]string{RancherProjectIDAnnotation: "local:p-abc"},
+				Labels:      map[string]string{RancherProjectIDLabel: "p-abc"},
+			},
+		}
+		newNamespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name:        "test-ns",
+				Annotations: oldNamespace.Metadata.Annotations,
+				Labels:      tc.newLabels,
+			},
+		}
+
+		// the Namespace doesn't move: the Project is not looked up
+		host.Client = &mocks.MockWapcClient{}
+
+		userInfo := kubewarden_protocol.UserInfo{Username: "alice"}
+		response := runValidation(t, "UPDATE", namespaceKind, &newNamespace, &oldNamespace, &userInfo, &tc.settings)
+		if response.Accepted != tc.isValid {
+			t.Errorf("%s - expected accepted to be %v, got %v", tc.desc, tc.isValid, response.Accepted)
+		}
+
+		mutatedNamespace := mutatedNamespace(t, &response)
+		if tc.expectedLabel == "" {
+			if mutatedNamespace != nil {
+				t.Errorf("%s - the namespace was not supposed to be mutated", tc.desc)
+			}
+			continue
+		}
+
+		if mutatedNamespace == nil {
+			t.Errorf("%s - the namespace was supposed to be mutated", tc.desc)
+			continue
+		}
+		if label := mutatedNamespace.Metadata.Labels[RancherProjectIDLabel]; label != tc.expectedLabel {
+			t.Errorf("%s - wrong label. Got '%s' instead of '%s'", tc.desc, label, tc.expectedLabel)
+		}
+	}
+}
+
+func TestResourceQuotaChange(t *testing.T) {
+	sarAttributes := ResourceAttributes{
+		Namespace: "local",
+		Verb:      "update",
+		Group:     RancherManagementGroup,
+		Resource:  RancherProjectsResource,
+	}
+
+	cases := []struct {
+		desc      string
+		settings  Settings
+		oldQuota  string
+		newQuota  string
+		sarStatus *kubernetes.SubjectAccessReviewStatus
+		isValid   bool
+	}{
+		{
+			"changes not restricted",
+			Settings{},
+			`{"limit":{"pods":"10"}}`,
+			`{"limit":{"pods":"20"}}`,
+			nil,
+			true,
+		},
+		{
+			"quota not changed",
+			Settings{ResourceQuotaChange: &PrivilegedOperation{ResourceAttributes: &sarAttributes}},
+			`{"limit":{"pods":"10"}}`,
+			`{"limit":{"pods":"10"}}`,
+			nil,
+			true,
+		},
+		{
+			"user is allowed",
+			Settings{ResourceQuotaChange: &PrivilegedOperation{Users: []string{"alice"}}},
+			`{"limit":{"pods":"10"}}`,
+			`{"limit":{"pods":"20"}}`,
+			nil,
+			true,
+		},
+		{
+			"user passes the SubjectAccessReview",
+			Settings{ResourceQuotaChange: &PrivilegedOperation{ResourceAttributes: &sarAttributes}},
+			`{"limit":{"pods":"10"}}`,
+			`{"limit":{"pods":"20"}}`,
+			&kubernetes.SubjectAccessReviewStatus{Allowed: true},
+			true,
+		},
+		{
+			"user doesn't pass the SubjectAccessReview",
+			Settings{ResourceQuotaChange: &PrivilegedOperation{ResourceAttributes: &sarAttributes}},
+			`{"limit":{"pods":"10"}}`,
+			`{"limit":{"pods":"20"}}`,
+			&kubernetes.SubjectAccessReviewStatus{Allowed: false},
+			false,
+		},
+		{
+			"quota removed",
+			Settings{ResourceQuotaChange: &PrivilegedOperation{ResourceAttributes: &sarAttributes}},
+			`{"limit":{"pods":"10"}}`,
+			"",
+			&kubernetes.SubjectAccessReviewStatus{Allowed: false},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		oldAnnotations := map[string]string{
+			RancherProjectIDAnnotation:     "local:p-abcde",
+			RancherResourceQuotaAnnotation: tc.oldQuota,
+		}
+		newAnnotations := map[string]string{
+			RancherProjectIDAnnotation: "local:p-abcde",
+		}
+		if tc.newQuota != "" {
+			newAnnotations[RancherResourceQuotaAnnotation] = tc.newQuota
+		}
+
+		oldNamespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{Name: "test-ns", Annotations: oldAnnotations},
+		}
+		newNamespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{Name: "test-ns", Annotations: newAnnotations},
+		}
+		userInfo := kubewarden_protocol.UserInfo{
+			Username: "alice",
+			Groups:   []string{"developers"},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		if tc.sarStatus != nil {
+			mockCanI(t, mockWapcClient, &userInfo, sarAttributes, *tc.sarStatus, nil)
+		}
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "UPDATE", namespaceKind, &newNamespace, &oldNamespace, &userInfo, &tc.settings)
+		if response.Accepted != tc.isValid {
+			t.Errorf("%s - expected accepted to be %v, got %v", tc.desc, tc.isValid, response.Accepted)
+		}
+		if !response.Accepted && (response.Message == nil || !strings.Contains(*response.Message, "'update' verb on projects.management.cattle.io")) {
+			t.Errorf("%s - the rejection message doesn't name the required permission: %v", tc.desc, response.Message)
+		}
+	}
+}
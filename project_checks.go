@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
+	kubewarden "github.com/kubewarden/policy-sdk-go"
+	kubewarden_protocol "github.com/kubewarden/policy-sdk-go/protocol"
+	"github.com/kubewarden/rancher-project-quotas-namespace-validator/resource"
+)
+
+// NamespaceDefaultQuotaExceedsProjectQuotaError is a custom error raised
+// when the default quota of the Namespaces is bigger than the quota of
+// the whole Project
+type NamespaceDefaultQuotaExceedsProjectQuotaError struct {
+	namespaceDefault string
+	project          string
+}
+
+func (e *NamespaceDefaultQuotaExceedsProjectQuotaError) Error() string {
+	return fmt.Sprintf("Namespace default limit exceeds the project limit: namespace default %s, project %s", e.namespaceDefault, e.project)
+}
+
+// ContainerDefaultExceedsNamespaceDefaultQuotaError is a custom error raised
+// when the default resources of a container are bigger than the default
+// quota of the Namespaces
+type ContainerDefaultExceedsNamespaceDefaultQuotaError struct {
+	containerDefault string
+	namespaceDefault string
+}
+
+func (e *ContainerDefaultExceedsNamespaceDefaultQuotaError) Error() string {
+	return fmt.Sprintf("Container default limit exceeds the namespace default limit: container default %s, namespace default %s", e.containerDefault, e.namespaceDefault)
+}
+
+// ProjectLimitBelowAllocatedError is a custom error raised when the limit of
+// a Project is lower than the resources already allocated by its Namespaces
+type ProjectLimitBelowAllocatedError struct {
+	limit     string
+	allocated string
+	holders   []string
+}
+
+func (e *ProjectLimitBelowAllocatedError) Error() string {
+	return fmt.Sprintf("Project limit is lower than the quota already allocated by its namespaces: limit %s, allocated %s by %s",
+		e.limit, e.allocated, strings.Join(e.holders, ", "))
+}
+
+// projectSpecQuotas holds the quotas of a ProjectSpec, the ones that are
+// not set are empty
+type projectSpecQuotas struct {
+	limit            ResourceQuotaLimit
+	usedLimit        ResourceQuotaLimit
+	namespaceDefault ResourceQuotaLimit
+	containerDefault ContainerResourceLimit
+}
+
+func newProjectSpecQuotas(spec *ProjectSpec) projectSpecQuotas {
+	quotas := projectSpecQuotas{}
+	if spec == nil {
+		return quotas
+	}
+
+	if spec.ResourceQuota != nil {
+		quotas.limit = spec.ResourceQuota.Limit
+		quotas.usedLimit = spec.ResourceQuota.UsedLimit
+	}
+	if spec.NamespaceDefaultResourceQuota != nil {
+		quotas.namespaceDefault = spec.NamespaceDefaultResourceQuota.Limit
+	}
+	if spec.ContainerDefaultResourceLimit != nil {
+		quotas.containerDefault = *spec.ContainerDefaultResourceLimit
+	}
+
+	return quotas
+}
+
+// validateProjectRequest validates the creation and the update of Projects
+func validateProjectRequest(validationRequest *kubewarden_protocol.ValidationRequest, settings *Settings) ([]byte, error) {
+	project := Project{}
+	if err := json.Unmarshal(validationRequest.Request.Object, &project); err != nil {
+		return kubewarden.RejectRequest(
+			kubewarden.Message(
+				fmt.Sprintf("Cannot decode Project object: %s", err.Error())),
+			kubewarden.Code(400))
+	}
+
+	if project.Spec == nil {
+		return kubewarden.AcceptRequest()
+	}
+
+	oldProject := Project{}
+	if validationRequest.Request.Operation == "UPDATE" {
+		if err := json.Unmarshal(validationRequest.Request.OldObject, &oldProject); err != nil {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(
+					fmt.Sprintf("Cannot decode old Project object: %s", err.Error())),
+				kubewarden.Code(400))
+		}
+	}
+
+	// The checks are done only against the quotas changed by the request,
+	// hence Projects created before the policy was deployed can still be
+	// updated (e.g. by the Rancher controllers). On creation everything is
+	// considered as changed.
+	quotas := newProjectSpecQuotas(project.Spec)
+	oldQuotas := newProjectSpecQuotas(oldProject.Spec)
+
+	if err := validateProjectQuantities(&quotas, &oldQuotas); err != nil {
+		return kubewarden.RejectRequest(
+			kubewarden.Message(err.Error()),
+			kubewarden.NoCode)
+	}
+
+	if quotas.limit != oldQuotas.limit || quotas.namespaceDefault != oldQuotas.namespaceDefault {
+		if err := validateNamespaceDefaultQuota(project.Spec); err != nil {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(err.Error()),
+				kubewarden.NoCode)
+		}
+	}
+
+	if quotas.containerDefault != oldQuotas.containerDefault || quotas.namespaceDefault != oldQuotas.namespaceDefault {
+		if err := validateContainerDefaultLimit(project.Spec); err != nil {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(err.Error()),
+				kubewarden.NoCode)
+		}
+	}
+
+	if settings.ConfigMap != "" {
+		if lookupError := mergeConfigMapSettings(settings); lookupError != nil {
+			return kubewarden.RejectRequest(
+				lookupError.Message,
+				lookupError.StatusCode)
+		}
+	}
+
+	// on creation all the limits are considered as changed
+	changedLimits := changedProjectLimits(&oldProject, &project)
+
+	// raising a limit is always allowed, even when it stays below the
+	// allocated quota: that's how an over-committed Project is repaired
+	reducedLimits := reducedProjectLimits(changedLimits, &oldQuotas.limit, &quotas.limit)
+
+	// the Namespaces can be listed only for the Projects of the cluster the
+	// policy is running on, the ones of the downstream clusters live
+	// elsewhere
+	if validationRequest.Request.Operation == "UPDATE" && project.Metadata != nil &&
+		project.Metadata.Namespace == settings.ClusterName && len(reducedLimits) > 0 {
+		namespaces, lookupError := listProjectNamespaces(project.Metadata.Name, "")
+		if lookupError != nil {
+			return kubewarden.RejectRequest(
+				lookupError.Message,
+				lookupError.StatusCode)
+		}
+
+		projectKey := fmt.Sprintf("%s:%s", project.Metadata.Namespace, project.Metadata.Name)
+		if err := validateProjectLimitsVsAllocated(projectKey, &project.Spec.ResourceQuota.Limit, reducedLimits, namespaces); err != nil {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(err.Error()),
+				kubewarden.NoCode)
+		}
+	}
+
+	// the Nodes can be checked only for the Projects of the cluster the
+	// policy is running on
+	capacityFields := clusterCapacityFields(changedLimits)
+	if settings.ClusterCapacity != nil && project.Metadata != nil &&
+		project.Metadata.Namespace == settings.ClusterName && len(capacityFields) > 0 {
+		nodes, lookupError := listNodes()
+		if lookupError != nil {
+			return kubewarden.RejectRequest(
+				lookupError.Message,
+				lookupError.StatusCode)
+		}
+
+		projects, lookupError := listClusterProjects(settings.ClusterName)
+		if lookupError != nil {
+			return kubewarden.RejectRequest(
+				lookupError.Message,
+				lookupError.StatusCode)
+		}
+
+		if err := validateClusterCapacity(&project, projects, nodes, capacityFields, settings.ClusterCapacity.OvercommitFactor); err != nil {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(err.Error()),
+				kubewarden.NoCode)
+		}
+	}
+
+	return kubewarden.AcceptRequest()
+}
+
+// validateProjectQuantities ensures the quantities of the Project can be
+// parsed. Otherwise the error would show up only later, when validating the
+// Namespaces of the Project. Only the quantities that differ from the old
+// ones are checked, hence the Projects already holding malformed quantities
+// can still be updated.
+func validateProjectQuantities(quotas, oldQuotas *projectSpecQuotas) error {
+	type quotaLimits struct {
+		path     string
+		limit    *ResourceQuotaLimit
+		oldLimit *ResourceQuotaLimit
+	}
+
+	limits := []quotaLimits{
+		{"resourceQuota.limit", &quotas.limit, &oldQuotas.limit},
+		{"resourceQuota.usedLimit", &quotas.usedLimit, &oldQuotas.usedLimit},
+		{"namespaceDefaultResourceQuota.limit", &quotas.namespaceDefault, &oldQuotas.namespaceDefault},
+	}
+
+	errors := []error{}
+
+	for _, l := range limits {
+		for _, field := range resourceQuotaFields {
+			value := *field.Value(l.limit)
+			if value == "" || value == *field.Value(l.oldLimit) {
+				continue
+			}
+			if _, err := resource.ParseQuantity(value); err != nil {
+				errors = append(errors, fmt.Errorf("%s.%s: %w", l.path, field.Key, &QuantityParseError{
+					Message: fmt.Sprintf("Cannot convert '%s' to quantity", value),
+					Err:     err,
+				}))
+			}
+		}
+	}
+
+	for _, field := range containerResourceLimitFields {
+		value := *field.Value(&quotas.containerDefault)
+		if value == "" || value == *field.Value(&oldQuotas.containerDefault) {
+			continue
+		}
+		if _, err := resource.ParseQuantity(value); err != nil {
+			errors = append(errors, fmt.Errorf("containerDefaultResourceLimit.%s: %w", field.Key, &QuantityParseError{
+				Message: fmt.Sprintf("Cannot convert '%s' to quantity", value),
+				Err:     err,
+			}))
+		}
+	}
+
+	return joinErrors(errors)
+}
+
+// validateContainerDefaultLimit ensures the default resources of the
+// containers fit inside of the default quota of the Namespaces. Otherwise
+// the containers without explicit resources could not be created inside of
+// the Namespaces using the default quota.
+func validateContainerDefaultLimit(spec *ProjectSpec) error {
+	if spec.ContainerDefaultResourceLimit == nil || spec.NamespaceDefaultResourceQuota == nil {
+		return nil
+	}
+
+	errors := []error{}
+
+	for _, containerField := range containerResourceLimitFields {
+		containerDefault := *containerField.Value(spec.ContainerDefaultResourceLimit)
+		quotaField, _ := findResourceQuotaField(containerField.Key)
+		nsDefault := *quotaField.Value(&spec.NamespaceDefaultResourceQuota.Limit)
+		if containerDefault == "" || nsDefault == "" {
+			continue
+		}
+
+		containerDefaultQuantity, err := resource.ParseQuantity(containerDefault)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%s limit: %w", containerField.Name, &QuantityParseError{
+				Message: "Cannot convert container default limit to quantity",
+				Err:     err,
+			}))
+			continue
+		}
+
+		nsDefaultQuantity, err := resource.ParseQuantity(nsDefault)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%s limit: %w", containerField.Name, &QuantityParseError{
+				Message: "Cannot convert namespace default limit to quantity",
+				Err:     err,
+			}))
+			continue
+		}
+
+		if containerDefaultQuantity.Cmp(nsDefaultQuantity) > 0 {
+			errors = append(errors, fmt.Errorf("%s limit: %w", containerField.Name, &ContainerDefaultExceedsNamespaceDefaultQuotaError{
+				containerDefault: containerDefaultQuantity.String(),
+				namespaceDefault: nsDefaultQuantity.String(),
+			}))
+		}
+	}
+
+	return joinErrors(errors)
+}
+
+// changedProjectLimits returns the resources whose Project limit has been
+// set or changed by the update
+func changedProjectLimits(oldProject, project *Project) []resourceQuotaField {
+	if project.Spec.ResourceQuota == nil {
+		return nil
+	}
+
+	oldLimits := &ResourceQuotaLimit{}
+	if oldProject.Spec != nil && oldProject.Spec.ResourceQuota != nil {
+		oldLimits = &oldProject.Spec.ResourceQuota.Limit
+	}
+
+	changed := []resourceQuotaField{}
+	for _, field := range resourceQuotaFields {
+		newLimit := *field.Value(&project.Spec.ResourceQuota.Limit)
+		if newLimit != "" && newLimit != *field.Value(oldLimits) {
+			changed = append(changed, field)
+		}
+	}
+
+	return changed
+}
+
+// reducedProjectLimits returns the resources among the given ones whose
+// limit has been lowered. A limit set for the first time, or replacing a
+// malformed one, is considered as lowered.
+func reducedProjectLimits(fields []resourceQuotaField, oldLimits, newLimits *ResourceQuotaLimit) []resourceQuotaField {
+	reduced := []resourceQuotaField{}
+	for _, field := range fields {
+		oldLimitQuantity, err := resource.ParseQuantity(*field.Value(oldLimits))
+		if err != nil {
+			reduced = append(reduced, field)
+			continue
+		}
+
+		newLimitQuantity, err := resource.ParseQuantity(*field.Value(newLimits))
+		if err != nil || newLimitQuantity.Cmp(oldLimitQuantity) < 0 {
+			reduced = append(reduced, field)
+		}
+	}
+
+	return reduced
+}
+
+// validateProjectLimitsVsAllocated ensures the Project limits are not lower
+// than the resources already allocated by the Namespaces of the Project.
+// Only the given resources are checked.
+func validateProjectLimitsVsAllocated(projectKey string, prjLimits *ResourceQuotaLimit, fields []resourceQuotaField, namespaces []*corev1.Namespace) error {
+	type namespaceQuota struct {
+		name  string
+		limit ResourceQuotaLimit
+	}
+
+	nsQuotas := []namespaceQuota{}
+	for _, ns := range namespaces {
+		if ns.Metadata == nil {
+			continue
+		}
+
+		nsProjectNamespace, nsProjectID, err := parseProjectIDAnnotation(ns.Metadata.Annotations[RancherProjectIDAnnotation])
+		if err != nil || fmt.Sprintf("%s:%s", nsProjectNamespace, nsProjectID) != projectKey {
+			continue
+		}
+
+		quotaRaw, found := ns.Metadata.Annotations[RancherResourceQuotaAnnotation]
+		if !found {
+			continue
+		}
+
+		nsQuota := NamespaceResourceQuota{}
+		if err := json.Unmarshal([]byte(quotaRaw), &nsQuota); err != nil {
+			return fmt.Errorf("cannot decode the %s annotation of Namespace %s: %w",
+				RancherResourceQuotaAnnotation, ns.Metadata.Name, err)
+		}
+		nsQuotas = append(nsQuotas, namespaceQuota{name: ns.Metadata.Name, limit: nsQuota.Limit})
+	}
+
+	errors := []error{}
+
+	for _, field := range fields {
+		prjLimitQuantity, err := resource.ParseQuantity(*field.Value(prjLimits))
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%s limit: %w", field.Name, &QuantityParseError{
+				Message: "Cannot convert project limit to quantity",
+				Err:     err,
+			}))
+			continue
+		}
+
+		allocated := resource.Quantity{}
+		holders := []string{}
+		for _, nsQuota := range nsQuotas {
+			limit := *field.Value(&nsQuota.limit)
+			if limit == "" {
+				continue
+			}
+
+			limitQuantity, err := resource.ParseQuantity(limit)
+			if err != nil {
+				return fmt.Errorf("%s limit: %w", field.Name, &QuantityParseError{
+					Message: fmt.Sprintf("Cannot convert limit of namespace %s to quantity", nsQuota.name),
+					Err:     err,
+				})
+			}
+			if limitQuantity.IsZero() {
+				continue
+			}
+
+			allocated.Add(limitQuantity)
+			holders = append(holders, fmt.Sprintf("%s (%s)", nsQuota.name, limitQuantity.String()))
+		}
+
+		if allocated.Cmp(prjLimitQuantity) > 0 {
+			errors = append(errors, fmt.Errorf("%s limit: %w", field.Name, &ProjectLimitBelowAllocatedError{
+				limit:     prjLimitQuantity.String(),
+				allocated: allocated.String(),
+				holders:   holders,
+			}))
+		}
+	}
+
+	return joinErrors(errors)
+}
+
+// validateNamespaceDefaultQuota ensures the default quota of the Namespaces
+// fits inside of the quota of the Project. Like Rancher Manager UI does, a
+// resource must be set either inside of both quotas or inside of none of them.
+func validateNamespaceDefaultQuota(spec *ProjectSpec) error {
+	prjLimits := &ResourceQuotaLimit{}
+	if spec.ResourceQuota != nil {
+		prjLimits = &spec.ResourceQuota.Limit
+	}
+
+	nsDefaultLimits := &ResourceQuotaLimit{}
+	if spec.NamespaceDefaultResourceQuota != nil {
+		nsDefaultLimits = &spec.NamespaceDefaultResourceQuota.Limit
+	}
+
+	errors := []error{}
+
+	for _, field := range resourceQuotaFields {
+		prjLimit := *field.Value(prjLimits)
+		nsDefaultLimit := *field.Value(nsDefaultLimits)
+
+		switch {
+		case prjLimit == "" && nsDefaultLimit == "":
+			continue
+		case nsDefaultLimit == "":
+			errors = append(errors, fmt.Errorf("%s limit: set inside of resourceQuota but not inside of namespaceDefaultResourceQuota", field.Name))
+			continue
+		case prjLimit == "":
+			errors = append(errors, fmt.Errorf("%s limit: set inside of namespaceDefaultResourceQuota but not inside of resourceQuota", field.Name))
+			continue
+		}
+
+		prjLimitQuantity, err := resource.ParseQuantity(prjLimit)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%s limit: %w", field.Name, &QuantityParseError{
+				Message: "Cannot convert project limit to quantity",
+				Err:     err,
+			}))
+			continue
+		}
+
+		nsDefaultLimitQuantity, err := resource.ParseQuantity(nsDefaultLimit)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("%s limit: %w", field.Name, &QuantityParseError{
+				Message: "Cannot convert namespace default limit to quantity",
+				Err:     err,
+			}))
+			continue
+		}
+
+		if nsDefaultLimitQuantity.Cmp(prjLimitQuantity) > 0 {
+			errors = append(errors, fmt.Errorf("%s limit: %w", field.Name, &NamespaceDefaultQuotaExceedsProjectQuotaError{
+				namespaceDefault: nsDefaultLimitQuantity.String(),
+				project:          prjLimitQuantity.String(),
+			}))
+		}
+	}
+
+	return joinErrors(errors)
+}
@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
+	metav1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/mocks"
+)
+
+func TestValidateNamespaceDefaultQuota(t *testing.T) {
+	cases := []struct {
+		desc        string
+		spec        ProjectSpec
+		expectError bool
+	}{
+		{
+			"no quotas",
+			ProjectSpec{},
+			false,
+		},
+		{
+			"namespace default fits",
+			ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsCPU: "2000m", LimitsMemory: "2048Mi"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsCPU: "2", LimitsMemory: "1Gi"},
+				},
+			},
+			false,
+		},
+		{
+			"namespace default exceeds the project",
+			ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsCPU: "2000m", LimitsMemory: "2048Mi"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsCPU: "2", LimitsMemory: "3Gi"},
+				},
+			},
+			true,
+		},
+		{
+			"resource missing from the namespace default",
+			ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsCPU: "2000m", LimitsMemory: "2048Mi"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsCPU: "1"},
+				},
+			},
+			true,
+		},
+		{
+			"resource missing from the project",
+			ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsCPU: "2000m"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsCPU: "1", Pods: "10"},
+				},
+			},
+			true,
+		},
+		{
+			"namespace default without project quota",
+			ProjectSpec{
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{Pods: "10"},
+				},
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		err := validateNamespaceDefaultQuota(&tc.spec)
+		if !tc.expectError && err != nil {
+			t.Errorf("%s: got an unexpected error: %v", tc.desc, err)
+		}
+		if tc.expectError && err == nil {
+			t.Errorf("%s: was expecting an error", tc.desc)
+		}
+	}
+}
+
+func TestValidateProjectQuantities(t *testing.T) {
+	cases := []struct {
+		desc        string
+		spec        ProjectSpec
+		expectError string
+	}{
+		{
+			"no quotas",
+			ProjectSpec{},
+			"",
+		},
+		{
+			"valid quantities",
+			ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					Limit:     ResourceQuotaLimit{LimitsMemory: "2Gi", Pods: "10"},
+					UsedLimit: ResourceQuotaLimit{LimitsMemory: "512Mi"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsMemory: "1Gi", Pods: "5"},
+				},
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{LimitsMemory: "128Mi", RequestsCPU: "100m"},
+			},
+			"",
+		},
+		{
+			"malformed project limit",
+			ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsMemory: "2GB"},
+				},
+			},
+			"resourceQuota.limit.limitsMemory",
+		},
+		{
+			"malformed used limit",
+			ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					UsedLimit: ResourceQuotaLimit{Pods: "ten"},
+				},
+			},
+			"resourceQuota.usedLimit.pods",
+		},
+		{
+			"malformed namespace default",
+			ProjectSpec{
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsStorage: "1 Gi"},
+				},
+			},
+			"namespaceDefaultResourceQuota.limit.requestsStorage",
+		},
+		{
+			"malformed container default",
+			ProjectSpec{
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{LimitsCPU: "1core"},
+			},
+			"containerDefaultResourceLimit.limitsCpu",
+		},
+	}
+
+	for _, tc := range cases {
+		quotas := newProjectSpecQuotas(&tc.spec)
+		err := validateProjectQuantities(&quotas, &projectSpecQuotas{})
+		if tc.expectError == "" && err != nil {
+			t.Errorf("%s: got an unexpected error: %v", tc.desc, err)
+		}
+		if tc.expectError != "" && (err == nil || !strings.Contains(err.Error(), tc.expectError)) {
+			t.Errorf("%s: was expecting an error about %s, got %v", tc.desc, tc.expectError, err)
+		}
+	}
+}
+
+func TestValidateContainerDefaultLimit(t *testing.T) {
+	cases := []struct {
+		desc        string
+		spec        ProjectSpec
+		expectError bool
+	}{
+		{
+			"no container default",
+			ProjectSpec{
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "100m"},
+				},
+			},
+			false,
+		},
+		{
+			"no namespace default",
+			ProjectSpec{
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{RequestsCPU: "2000m"},
+			},
+			false,
+		},
+		{
+			"container default fits",
+			ProjectSpec{
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "100m", LimitsMemory: "1Gi"},
+				},
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{RequestsCPU: "0.1", LimitsMemory: "512Mi"},
+			},
+			false,
+		},
+		{
+			"resource not limited by the namespace default",
+			ProjectSpec{
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "100m"},
+				},
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{RequestsCPU: "100m", LimitsMemory: "4Gi"},
+			},
+			false,
+		},
+		{
+			"container default exceeds the namespace default",
+			ProjectSpec{
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "100m"},
+				},
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{RequestsCPU: "2000m"},
+			},
+			true,
+		},
+		{
+			"malformed container default",
+			ProjectSpec{
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsMemory: "1Gi"},
+				},
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{LimitsMemory: "lots"},
+			},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		err := validateContainerDefaultLimit(&tc.spec)
+		if !tc.expectError && err != nil {
+			t.Errorf("%s: got an unexpected error: %v", tc.desc, err)
+		}
+		if tc.expectError && err == nil {
+			t.Errorf("%s: was expecting an error", tc.desc)
+		}
+	}
+}
+
+func TestValidateProjectRequest(t *testing.T) {
+	cases := []struct {
+		desc    string
+		spec    *ProjectSpec
+		isValid bool
+	}{
+		{
+			"no spec",
+			nil,
+			true,
+		},
+		{
+			"valid project",
+			&ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "500m"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "100m"},
+				},
+			},
+			true,
+		},
+		{
+			"namespace default exceeds the project",
+			&ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "500m"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "1"},
+				},
+			},
+			false,
+		},
+		{
+			"container default exceeds the namespace default",
+			&ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "500m"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "100m"},
+				},
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{RequestsCPU: "2000m"},
+			},
+			false,
+		},
+		{
+			"malformed project limit",
+			&ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsMemory: "2GB"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsMemory: "1Gi"},
+				},
+			},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		project := Project{
+			APIVersion: RancherProjectAPIVersion,
+			Kind:       RancherProjectKind,
+			Metadata: &metav1.ObjectMeta{
+				Name:      "p-abcde",
+				Namespace: "local",
+			},
+			Spec: tc.spec,
+		}
+
+		// no host capability is expected to be used
+		host.Client = &mocks.MockWapcClient{}
+
+		response := runValidation(t, "CREATE", projectKind, &project, nil, nil, &Settings{})
+		if response.Accepted != tc.isValid {
+			message := "no message set"
+			if response.Message != nil {
+				message = *response.Message
+			}
+			t.Errorf("%s - expected accepted to be %v, got %v: %s", tc.desc, tc.isValid, response.Accepted, message)
+		}
+	}
+}
+
+func TestNonCompliantProjectUpdate(t *testing.T) {
+	cases := []struct {
+		desc    string
+		spec    ProjectSpec
+		update  func(spec *ProjectSpec)
+		isValid bool
+	}{
+		{
+			"namespace default exceeds the project, used limit changed",
+			ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit:     ResourceQuotaLimit{RequestsCPU: "500m"},
+					UsedLimit: ResourceQuotaLimit{RequestsCPU: "100m"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "1"},
+				},
+			},
+			func(spec *ProjectSpec) {
+				spec.ResourceQuota.UsedLimit.RequestsCPU = "1100m"
+			},
+			true,
+		},
+		{
+			"namespace default exceeds the project, namespace default changed",
+			ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "500m"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "1"},
+				},
+			},
+			func(spec *ProjectSpec) {
+				spec.NamespaceDefaultResourceQuota.Limit.RequestsCPU = "2"
+			},
+			false,
+		},
+		{
+			// test_data/project.yaml
+			"container default exceeds the namespace default, used limit changed",
+			ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit:     ResourceQuotaLimit{LimitsCPU: "2000m", LimitsMemory: "2048Mi", RequestsCPU: "500m"},
+					UsedLimit: ResourceQuotaLimit{LimitsCPU: "400m", LimitsMemory: "1124Mi", RequestsCPU: "500m"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsCPU: "200m", LimitsMemory: "1024Mi", RequestsCPU: "100m"},
+				},
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{RequestsCPU: "2000m"},
+			},
+			func(spec *ProjectSpec) {
+				spec.ResourceQuota.UsedLimit = ResourceQuotaLimit{LimitsCPU: "600m", LimitsMemory: "2048Mi", RequestsCPU: "500m"}
+			},
+			true,
+		},
+		{
+			"container default exceeds the namespace default, container default changed",
+			ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "500m"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{RequestsCPU: "100m"},
+				},
+				ContainerDefaultResourceLimit: &ContainerResourceLimit{RequestsCPU: "2000m"},
+			},
+			func(spec *ProjectSpec) {
+				spec.ContainerDefaultResourceLimit.RequestsCPU = "1"
+			},
+			false,
+		},
+		{
+			"malformed project limit, used limit changed",
+			ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit:     ResourceQuotaLimit{LimitsMemory: "2GB"},
+					UsedLimit: ResourceQuotaLimit{LimitsMemory: "512Mi"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsMemory: "1Gi"},
+				},
+			},
+			func(spec *ProjectSpec) {
+				spec.ResourceQuota.UsedLimit.LimitsMemory = "1536Mi"
+			},
+			true,
+		},
+		{
+			"malformed project limit changed",
+			ProjectSpec{
+				ClusterName: "local",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsMemory: "2Gi"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsMemory: "1Gi"},
+				},
+			},
+			func(spec *ProjectSpec) {
+				spec.ResourceQuota.Limit.LimitsMemory = "3GB"
+			},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		oldProject := Project{
+			APIVersion: RancherProjectAPIVersion,
+			Kind:       RancherProjectKind,
+			Metadata: &metav1.ObjectMeta{
+				Name:      "p-abcde",
+				Namespace: "local",
+			},
+			Spec: &tc.spec,
+		}
+
+		// deep copy of the Project, the update changes only the new one
+		projectRaw, err := json.Marshal(&oldProject)
+		if err != nil {
+			t.Fatalf("cannot marshall project: %v", err)
+		}
+		project := Project{}
+		if err := json.Unmarshal(projectRaw, &project); err != nil {
+			t.Fatalf("cannot unmarshall project: %v", err)
+		}
+		tc.update(project.Spec)
+
+		// no host capability is expected to be used
+		host.Client = &mocks.MockWapcClient{}
+
+		response := runValidation(t, "UPDATE", projectKind, &project, &oldProject, nil, &Settings{})
+		if response.Accepted != tc.isValid {
+			message := "no message set"
+			if response.Message != nil {
+				message = *response.Message
+			}
+			t.Errorf("%s - expected accepted to be %v, got %v: %s", tc.desc, tc.isValid, response.Accepted, message)
+		}
+	}
+}
+
+func TestProjectQuotaReduction(t *testing.T) {
+	siblings := []*corev1.Namespace{
+		{
+			Metadata: &metav1.ObjectMeta{
+				Name: "one",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation:     "local:p-abcde",
+					RancherResourceQuotaAnnotation: `{"limit":{"limitsMemory":"1Gi","pods":"10"}}`,
+				},
+			},
+		},
+		{
+			Metadata: &metav1.ObjectMeta{
+				Name: "two",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation:     "local:p-abcde",
+					RancherResourceQuotaAnnotation: `{"limit":{"limitsMemory":"512Mi"}}`,
+				},
+			},
+		},
+		{
+			Metadata: &metav1.ObjectMeta{
+				Name: "other-cluster",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation:     "c-m-xyz:p-abcde",
+					RancherResourceQuotaAnnotation: `{"limit":{"limitsMemory":"10Gi"}}`,
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		desc      string
+		oldLimits ResourceQuotaLimit
+		newLimits ResourceQuotaLimit
+		listed    bool
+		isValid   bool
+	}{
+		{
+			"limits not changed",
+			ResourceQuotaLimit{LimitsMemory: "1Gi"},
+			ResourceQuotaLimit{LimitsMemory: "1Gi"},
+			false,
+			true,
+		},
+		{
+			"reduction above the allocated quota",
+			ResourceQuotaLimit{LimitsMemory: "4Gi"},
+			ResourceQuotaLimit{LimitsMemory: "1536Mi"},
+			true,
+			true,
+		},
+		{
+			"reduction below the allocated quota",
+			ResourceQuotaLimit{LimitsMemory: "4Gi"},
+			ResourceQuotaLimit{LimitsMemory: "1Gi"},
+			true,
+			false,
+		},
+		{
+			"increase still below the allocated quota",
+			ResourceQuotaLimit{LimitsMemory: "512Mi"},
+			ResourceQuotaLimit{LimitsMemory: "1Gi"},
+			false,
+			true,
+		},
+		{
+			"new limit below the allocated quota",
+			ResourceQuotaLimit{LimitsMemory: "4Gi"},
+			ResourceQuotaLimit{LimitsMemory: "4Gi", Pods: "5"},
+			true,
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		oldProject := Project{
+			Metadata: &metav1.ObjectMeta{Name: "p-abcde", Namespace: "local"},
+			Spec: &ProjectSpec{
+				ResourceQuota:                 &ProjectResourceQuota{Limit: tc.oldLimits},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{Limit: tc.oldLimits},
+			},
+		}
+		project := Project{
+			Metadata: &metav1.ObjectMeta{Name: "p-abcde", Namespace: "local"},
+			Spec: &ProjectSpec{
+				ResourceQuota:                 &ProjectResourceQuota{Limit: tc.newLimits},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{Limit: tc.newLimits},
+			},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		if tc.listed {
+			mockNamespaceListItems(t, mockWapcClient, "p-abcde", siblings)
+		}
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "UPDATE", projectKind, &project, &oldProject, nil, &Settings{ClusterName: "local"})
+		if response.Accepted != tc.isValid {
+			message := "no message set"
+			if response.Message != nil {
+				message = *response.Message
+			}
+			t.Errorf("%s - expected accepted to be %v, got %v: %s", tc.desc, tc.isValid, response.Accepted, message)
+		}
+		if !response.Accepted && (response.Message == nil || !strings.Contains(*response.Message, "one (")) {
+			t.Errorf("%s - the rejection message doesn't list the namespaces holding the quota: %v", tc.desc, response.Message)
+		}
+		if response.Message != nil && strings.Contains(*response.Message, "other-cluster") {
+			t.Errorf("%s - namespaces of other clusters must not be counted: %s", tc.desc, *response.Message)
+		}
+	}
+}
+
+func TestDownstreamProjectQuotaReduction(t *testing.T) {
+	oldProject := Project{
+		Metadata: &metav1.ObjectMeta{Name: "p-abcde", Namespace: "c-m-xyz"},
+		Spec: &ProjectSpec{
+			ResourceQuota:                 &ProjectResourceQuota{Limit: ResourceQuotaLimit{LimitsMemory: "4Gi"}},
+			NamespaceDefaultResourceQuota: &NamespaceResourceQuota{Limit: ResourceQuotaLimit{LimitsMemory: "512Mi"}},
+		},
+	}
+	project := Project{
+		Metadata: &metav1.ObjectMeta{Name: "p-abcde", Namespace: "c-m-xyz"},
+		Spec: &ProjectSpec{
+			ResourceQuota:                 &ProjectResourceQuota{Limit: ResourceQuotaLimit{LimitsMemory: "1Gi"}},
+			NamespaceDefaultResourceQuota: &NamespaceResourceQuota{Limit: ResourceQuotaLimit{LimitsMemory: "512Mi"}},
+		},
+	}
+
+	// the Namespaces of a downstream cluster are not visible to the policy:
+	// they must not be listed
+	host.Client = &mocks.MockWapcClient{}
+
+	response := runValidation(t, "UPDATE", projectKind, &project, &oldProject, nil, &Settings{ClusterName: "local"})
+	if !response.Accepted {
+		t.Errorf("expected the reduction of a downstream Project to be accepted, got: %v", *response.Message)
+	}
+}
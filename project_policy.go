@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ProjectEnforcementAnnotation is the Project annotation used to turn
+	// on and off the enforcement of the quotas. Allowed values are
+	// `enabled` and `disabled`
+	ProjectEnforcementAnnotation = "quotas.kubewarden.io/enforcement"
+
+	// ProjectOvercommitAnnotationPrefix is the prefix of the Project
+	// annotations used to set the overcommit ratio of a resource. The
+	// annotation is completed by the name of the resource, e.g.
+	// `quotas.kubewarden.io/overcommit-limitsCpu`
+	ProjectOvercommitAnnotationPrefix = "quotas.kubewarden.io/overcommit-"
+
+	// ProjectMaxNamespacesAnnotation is the Project annotation used to set
+	// the maximum number of Namespaces the Project can hold
+	ProjectMaxNamespacesAnnotation = "quotas.kubewarden.io/max-namespaces"
+
+	// EnforcementEnabled is the default enforcement mode
+	EnforcementEnabled = "enabled"
+
+	// EnforcementDisabled turns off the enforcement of the quotas
+	EnforcementDisabled = "disabled"
+)
+
+// projectPolicy holds the rules that apply to a specific Project: the
+// policy settings, with the Project annotations applied on top of them
+type projectPolicy struct {
+	enforcementDisabled bool
+	maxNamespaces       int
+	overcommitRatios    map[string]float64
+}
+
+// newProjectPolicy computes the rules to be enforced against the given
+// Project. `projectKey` is the `<cluster>:<project>` identifier of the Project.
+//
+// An error is returned when the Project has a malformed annotation.
+func newProjectPolicy(settings *Settings, projectKey string, project *Project) (projectPolicy, error) {
+	policy := projectPolicy{
+		maxNamespaces:    settings.MaxNamespaces(projectKey),
+		overcommitRatios: map[string]float64{},
+	}
+	for key, ratio := range settings.OvercommitRatios {
+		policy.overcommitRatios[key] = ratio
+	}
+
+	if project.Metadata == nil {
+		return policy, nil
+	}
+
+	for annotation, value := range project.Metadata.Annotations {
+		switch {
+		case annotation == ProjectEnforcementAnnotation:
+			switch value {
+			case EnforcementEnabled:
+				policy.enforcementDisabled = false
+			case EnforcementDisabled:
+				policy.enforcementDisabled = true
+			default:
+				return policy, fmt.Errorf("Project %s has an invalid annotation %s: '%s' is not one of '%s', '%s'",
+					projectKey, annotation, value, EnforcementEnabled, EnforcementDisabled)
+			}
+		case annotation == ProjectMaxNamespacesAnnotation:
+			maxNamespaces, err := strconv.Atoi(value)
+			if err != nil || maxNamespaces < 0 {
+				return policy, fmt.Errorf("Project %s has an invalid annotation %s: '%s' is not a non-negative integer",
+					projectKey, annotation, value)
+			}
+			policy.maxNamespaces = maxNamespaces
+		case strings.HasPrefix(annotation, ProjectOvercommitAnnotationPrefix):
+			key := strings.TrimPrefix(annotation, ProjectOvercommitAnnotationPrefix)
+			if _, found := findResourceQuotaField(key); !found {
+				return policy, fmt.Errorf("Project %s has an invalid annotation %s: unknown resource '%s'",
+					projectKey, annotation, key)
+			}
+			ratio, err := strconv.ParseFloat(value, 64)
+			if err != nil || ratio <= 0 {
+				return policy, fmt.Errorf("Project %s has an invalid annotation %s: '%s' is not a number greater than zero",
+					projectKey, annotation, value)
+			}
+			policy.overcommitRatios[key] = ratio
+		}
+	}
+
+	return policy, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewProjectPolicy(t *testing.T) {
+	projectKey := "local:p-abcde"
+
+	cases := []struct {
+		desc                string
+		settings            Settings
+		annotations         map[string]string
+		expectError         bool
+		enforcementDisabled bool
+		maxNamespaces       int
+		overcommitRatios    map[string]float64
+	}{
+		{
+			"no annotations",
+			Settings{
+				MaxNamespacesPerProject: 3,
+				OvercommitRatios:        map[string]float64{"limitsCpu": 2},
+			},
+			nil,
+			false,
+			false,
+			3,
+			map[string]float64{"limitsCpu": 2},
+		},
+		{
+			"annotations override the settings",
+			Settings{
+				MaxNamespacesPerProject: 3,
+				OvercommitRatios:        map[string]float64{"limitsCpu": 2},
+			},
+			map[string]string{
+				ProjectMaxNamespacesAnnotation:                  "10",
+				ProjectOvercommitAnnotationPrefix + "limitsCpu": "1",
+				ProjectOvercommitAnnotationPrefix + "pods":      "1.5",
+			},
+			false,
+			false,
+			10,
+			map[string]float64{"limitsCpu": 1, "pods": 1.5},
+		},
+		{
+			"enforcement disabled",
+			Settings{},
+			map[string]string{ProjectEnforcementAnnotation: EnforcementDisabled},
+			false,
+			true,
+			0,
+			map[string]float64{},
+		},
+		{
+			"unrelated annotations are ignored",
+			Settings{},
+			map[string]string{"quotas.kubewarden.io/something-else": "boom"},
+			false,
+			false,
+			0,
+			map[string]float64{},
+		},
+		{
+			"invalid enforcement",
+			Settings{},
+			map[string]string{ProjectEnforcementAnnotation: "off"},
+			true,
+			false,
+			0,
+			nil,
+		},
+		{
+			"invalid max namespaces",
+			Settings{},
+			map[string]string{ProjectMaxNamespacesAnnotation: "-1"},
+			true,
+			false,
+			0,
+			nil,
+		},
+		{
+			"overcommit of unknown resource",
+			Settings{},
+			map[string]string{ProjectOvercommitAnnotationPrefix + "gpus": "2"},
+			true,
+			false,
+			0,
+			nil,
+		},
+		{
+			"invalid overcommit ratio",
+			Settings{},
+			map[string]string{ProjectOvercommitAnnotationPrefix + "limitsCpu": "twice"},
+			true,
+			false,
+			0,
+			nil,
+		},
+	}
+
+	for _, tc := range cases {
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:        "p-abcde",
+				Namespace:   "local",
+				Annotations: tc.annotations,
+			},
+			Spec: &ProjectSpec{},
+		}
+
+		policy, err := newProjectPolicy(&tc.settings, projectKey, &project)
+		if tc.expectError {
+			if err == nil {
+				t.Errorf("%s - was expecting an error", tc.desc)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s - unexpected error: %v", tc.desc, err)
+			continue
+		}
+
+		if policy.enforcementDisabled != tc.enforcementDisabled {
+			t.Errorf("%s - wrong enforcementDisabled. Got %v instead of %v", tc.desc, policy.enforcementDisabled, tc.enforcementDisabled)
+		}
+		if policy.maxNamespaces != tc.maxNamespaces {
+			t.Errorf("%s - wrong maxNamespaces. Got %d instead of %d", tc.desc, policy.maxNamespaces, tc.maxNamespaces)
+		}
+		if len(policy.overcommitRatios) != len(tc.overcommitRatios) {
+			t.Errorf("%s - wrong overcommitRatios. Got %v instead of %v", tc.desc, policy.overcommitRatios, tc.overcommitRatios)
+		}
+		for key, ratio := range tc.overcommitRatios {
+			if policy.overcommitRatios[key] != ratio {
+				t.Errorf("%s - wrong overcommit ratio for %s. Got %v instead of %v", tc.desc, key, policy.overcommitRatios[key], ratio)
+			}
+		}
+	}
+}
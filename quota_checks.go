@@ -1,9 +1,16 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 
+	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
+	meta_v1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+	kubewarden_protocol "github.com/kubewarden/policy-sdk-go/protocol"
+	inf "gopkg.in/inf.v0"
+
 	"github.com/kubewarden/rancher-project-quotas-namespace-validator/resource"
 )
 
@@ -18,6 +25,17 @@ func (e *QuantityParseError) Error() string {
 	return fmt.Sprintf("%s: %v", e.Message, e.Err)
 }
 
+// CreatorQuotaExceededError is a custom error raised when the Namespaces
+// created by the same user allocate more resources than allowed
+type CreatorQuotaExceededError struct {
+	allocated string
+	allowed   string
+}
+
+func (e *CreatorQuotaExceededError) Error() string {
+	return fmt.Sprintf("Namespaces created by the user would allocate %s, the maximum allowed per creator is %s", e.allocated, e.allowed)
+}
+
 // NamespaceRequestExceedsAvailabilityError a custom error raised when
 // a namespace requests more resources than available
 type NamespaceRequestExceedsAvailabilityError struct {
@@ -29,15 +47,82 @@ func (e *NamespaceRequestExceedsAvailabilityError) Error() string {
 	return fmt.Sprintf("Namespace requested limit exceeds the availability of the project resource: requested %s, available %s", e.requested, e.available)
 }
 
+// resourceQuotaField describes one of the resources defined inside of a
+// ResourceQuotaLimit.
+//
+// Note: TinyGo has a limited support of reflection, hence the resources are
+// accessed through these explicit getters.
+type resourceQuotaField struct {
+	// Name is the name of the resource used inside of the messages shown
+	// to the user
+	Name string
+	// Key is the name of the resource inside of the JSON representation of
+	// ResourceQuotaLimit
+	Key string
+	// Value returns a pointer to the resource inside of the given ResourceQuotaLimit
+	Value func(limit *ResourceQuotaLimit) *string
+}
+
+// nolint: staticcheck // keep k8s resources capitalized
+var resourceQuotaFields = []resourceQuotaField{
+	{"Pods", "pods", func(l *ResourceQuotaLimit) *string { return &l.Pods }},
+	{"Services", "services", func(l *ResourceQuotaLimit) *string { return &l.Services }},
+	{"ReplicationControllers", "replicationControllers", func(l *ResourceQuotaLimit) *string { return &l.ReplicationControllers }},
+	{"Secrets", "secrets", func(l *ResourceQuotaLimit) *string { return &l.Secrets }},
+	{"ConfigMaps", "configMaps", func(l *ResourceQuotaLimit) *string { return &l.ConfigMaps }},
+	{"PersistentVolumeClaims", "persistentVolumeClaims", func(l *ResourceQuotaLimit) *string { return &l.PersistentVolumeClaims }},
+	{"ServicesNodePorts", "servicesNodePorts", func(l *ResourceQuotaLimit) *string { return &l.ServicesNodePorts }},
+	{"ServicesLoadBalancers", "servicesLoadBalancers", func(l *ResourceQuotaLimit) *string { return &l.ServicesLoadBalancers }},
+	{"RequestsCPU", "requestsCpu", func(l *ResourceQuotaLimit) *string { return &l.RequestsCPU }},
+	{"RequestsMemory", "requestsMemory", func(l *ResourceQuotaLimit) *string { return &l.RequestsMemory }},
+	{"RequestsStorage", "requestsStorage", func(l *ResourceQuotaLimit) *string { return &l.RequestsStorage }},
+	{"LimitsCPU", "limitsCpu", func(l *ResourceQuotaLimit) *string { return &l.LimitsCPU }},
+	{"LimitsMemory", "limitsMemory", func(l *ResourceQuotaLimit) *string { return &l.LimitsMemory }},
+}
+
+// containerResourceLimitField describes one of the resources defined inside
+// of a ContainerResourceLimit
+type containerResourceLimitField struct {
+	// Name is the name of the resource used inside of the messages shown
+	// to the user
+	Name string
+	// Key is the name of the resource inside of the JSON representation of
+	// ContainerResourceLimit, which is the same used by ResourceQuotaLimit
+	Key string
+	// Value returns a pointer to the resource inside of the given ContainerResourceLimit
+	Value func(limit *ContainerResourceLimit) *string
+}
+
+// nolint: staticcheck // keep k8s resources capitalized
+var containerResourceLimitFields = []containerResourceLimitField{
+	{"RequestsCPU", "requestsCpu", func(l *ContainerResourceLimit) *string { return &l.RequestsCPU }},
+	{"RequestsMemory", "requestsMemory", func(l *ContainerResourceLimit) *string { return &l.RequestsMemory }},
+	{"LimitsCPU", "limitsCpu", func(l *ContainerResourceLimit) *string { return &l.LimitsCPU }},
+	{"LimitsMemory", "limitsMemory", func(l *ContainerResourceLimit) *string { return &l.LimitsMemory }},
+}
+
+// findResourceQuotaField returns the resourceQuotaField with the given key
+func findResourceQuotaField(key string) (resourceQuotaField, bool) {
+	for _, field := range resourceQuotaFields {
+		if field.Key == key {
+			return field, true
+		}
+	}
+	return resourceQuotaField{}, false
+}
+
 // Compares the amount of resources requested by a namespace against the
 // availability of a project.
 //
+// The project limit is multiplied by the `overcommitRatio`, a ratio of 1
+// means no overcommit is allowed.
+//
 // Returns an error when one of these situation occurs:
 //   - The given strings cannot be converted to a Kubernetes Quantity
 //   - The project is already out of resources
 //   - The namespace has requested too much of a resource compared to the availability
 //     of the project
-func checkLimitVsAvailableQuota(nsLimit, prjLimit, prjUsed string) error {
+func checkLimitVsAvailableQuota(nsLimit, prjLimit, prjUsed string, overcommitRatio float64) error {
 	if nsLimit == "" {
 		nsLimit = "0"
 	}
@@ -49,23 +134,59 @@ func checkLimitVsAvailableQuota(nsLimit, prjLimit, prjUsed string) error {
 		}
 	}
 
+	prjAvailableQuantity, err := availableQuota(prjLimit, prjUsed, overcommitRatio)
+	if err != nil {
+		return err
+	}
+
+	if nsLimitQuantity.Cmp(prjAvailableQuantity) > 0 {
+		return &NamespaceRequestExceedsAvailabilityError{
+			requested: nsLimitQuantity.String(),
+			available: prjAvailableQuantity.String(),
+		}
+	}
+
+	return nil
+}
+
+// scaleQuantity multiplies the quantity by the given factor. The decimal
+// representation of the quantity is used, hence big quantities don't
+// overflow. The result is rounded down to the milli unit.
+func scaleQuantity(quantity resource.Quantity, factor float64) resource.Quantity {
+	factorDec, ok := new(inf.Dec).SetString(strconv.FormatFloat(factor, 'f', -1, 64))
+	if !ok {
+		return quantity
+	}
+
+	scaled := new(inf.Dec).Mul(quantity.AsDec(), factorDec)
+	scaled.Round(scaled, 3, inf.RoundDown)
+
+	return *resource.NewDecimalQuantity(*scaled, quantity.Format)
+}
+
+// availableQuota returns the quota of the Project that is not yet allocated.
+// The overcommit ratio is applied to the Project limit.
+func availableQuota(prjLimit, prjUsed string, overcommitRatio float64) (resource.Quantity, error) {
 	if prjLimit == "" {
 		prjLimit = "0"
 	}
 	prjLimitQuantity, err := resource.ParseQuantity(prjLimit)
 	if err != nil {
-		return &QuantityParseError{
+		return resource.Quantity{}, &QuantityParseError{
 			Message: "Cannot convert project limit to quantity",
 			Err:     err,
 		}
 	}
+	if overcommitRatio != 1 {
+		prjLimitQuantity = scaleQuantity(prjLimitQuantity, overcommitRatio)
+	}
 
 	if prjUsed == "" {
 		prjUsed = "0"
 	}
 	prjUsedQuantity, err := resource.ParseQuantity(prjUsed)
 	if err != nil {
-		return &QuantityParseError{
+		return resource.Quantity{}, &QuantityParseError{
 			Message: "Cannot convert project used quota to quantity",
 			Err:     err,
 		}
@@ -74,18 +195,31 @@ func checkLimitVsAvailableQuota(nsLimit, prjLimit, prjUsed string) error {
 	prjAvailableQuantity := prjLimitQuantity.DeepCopy()
 	prjAvailableQuantity.Sub(prjUsedQuantity)
 
-	if nsLimitQuantity.Cmp(prjAvailableQuantity) > 0 {
-		return &NamespaceRequestExceedsAvailabilityError{
-			requested: nsLimitQuantity.String(),
-			available: prjAvailableQuantity.String(),
-		}
+	return prjAvailableQuantity, nil
+}
+
+// joinErrors merges the given errors into a single one, reporting all their
+// messages. Returns nil when there are no errors.
+func joinErrors(errors []error) error {
+	if len(errors) == 0 {
+		return nil
 	}
 
-	return nil
+	errorMsgs := []string{}
+	for _, err := range errors {
+		errorMsgs = append(errorMsgs, err.Error())
+	}
+
+	return fmt.Errorf("%s", strings.Join(errorMsgs, ", "))
 }
 
-func validateQuotas(project *Project, nsLimits *ResourceQuotaLimit) error {
-	if project.Spec.ResourceQuota == nil {
+// validateQuotas ensures the limits requested by a Namespace fit inside of
+// the availability of the Project.
+//
+// `overcommitRatios` is indexed by the JSON key of the resource, resources
+// not listed there cannot be overcommitted.
+func validateQuotas(project *Project, nsLimits *ResourceQuotaLimit, overcommitRatios map[string]float64, malformedActions map[string]MalformedQuantityAction) error {
+	if project.Spec == nil || project.Spec.ResourceQuota == nil {
 		return nil
 	}
 
@@ -95,92 +229,156 @@ func validateQuotas(project *Project, nsLimits *ResourceQuotaLimit) error {
 
 	errors := []error{}
 
-	// Pods
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.Pods, project.Spec.ResourceQuota.Limit.Pods, project.Spec.ResourceQuota.UsedLimit.Pods); err != nil {
-		errors = append(errors, fmt.Errorf("Pods limit: %w", err))
-	}
+	for _, field := range resourceQuotaFields {
+		overcommitRatio := 1.0
+		if ratio, found := overcommitRatios[field.Key]; found {
+			overcommitRatio = ratio
+		}
 
-	// Services
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.Services, project.Spec.ResourceQuota.Limit.Services, project.Spec.ResourceQuota.UsedLimit.Services); err != nil {
-		errors = append(errors, fmt.Errorf("Services limit: %w", err))
-	}
+		nsLimit := *field.Value(nsLimits)
+		prjLimit := *field.Value(&project.Spec.ResourceQuota.Limit)
+		prjUsed := *field.Value(&project.Spec.ResourceQuota.UsedLimit)
 
-	// ReplicationControllers
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.ReplicationControllers, project.Spec.ResourceQuota.Limit.ReplicationControllers, project.Spec.ResourceQuota.UsedLimit.ReplicationControllers); err != nil {
-		errors = append(errors, fmt.Errorf("ReplicationControllers limit: %w", err))
-	}
+		// a malformed namespace quantity is always reported
+		if _, nsErr := resource.ParseQuantity(nsLimit); nsLimit == "" || nsErr == nil {
+			switch malformedActions[field.Key] {
+			case MalformedQuantitySkip:
+				if err := checkProjectQuantities(&project.Spec.ResourceQuota.Limit, &project.Spec.ResourceQuota.UsedLimit, field); err != nil {
+					projectName := ""
+					if project.Metadata != nil {
+						projectName = project.Metadata.Name
+					}
+					logWarning(fmt.Sprintf("Project %s: %s limit: %v: the check of the resource is skipped",
+						projectName, field.Name, err))
+					continue
+				}
+			case MalformedQuantityUnlimited:
+				// a malformed limit doesn't limit the resource, while a
+				// malformed used limit is not known: the Namespace must
+				// still fit inside of the whole Project limit
+				if _, err := resource.ParseQuantity(prjLimit); prjLimit != "" && err != nil {
+					continue
+				}
+				if _, err := resource.ParseQuantity(prjUsed); prjUsed != "" && err != nil {
+					prjUsed = ""
+				}
+			}
+		}
 
-	// Secrets
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.Secrets, project.Spec.ResourceQuota.Limit.Secrets, project.Spec.ResourceQuota.UsedLimit.Secrets); err != nil {
-		errors = append(errors, fmt.Errorf("Secrets limit: %w", err))
+		if err := checkLimitVsAvailableQuota(nsLimit, prjLimit, prjUsed, overcommitRatio); err != nil {
+			errors = append(errors, fmt.Errorf("%s limit: %w", field.Name, err))
+		}
 	}
 
-	// ConfigMaps
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.ConfigMaps, project.Spec.ResourceQuota.Limit.ConfigMaps, project.Spec.ResourceQuota.UsedLimit.ConfigMaps); err != nil {
-		errors = append(errors, fmt.Errorf("ConfigMaps limit: %w", err))
-	}
+	return joinErrors(errors)
+}
 
-	// PersistentVolumeClaims
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.PersistentVolumeClaims, project.Spec.ResourceQuota.Limit.PersistentVolumeClaims, project.Spec.ResourceQuota.UsedLimit.PersistentVolumeClaims); err != nil {
-		errors = append(errors, fmt.Errorf("PersistentVolumeClaims limit: %w", err))
+// checkProjectQuantities returns an error when the limit or the used limit
+// of the given resource cannot be parsed
+func checkProjectQuantities(prjLimits, prjUsed *ResourceQuotaLimit, field resourceQuotaField) error {
+	if prjLimit := *field.Value(prjLimits); prjLimit != "" {
+		if _, err := resource.ParseQuantity(prjLimit); err != nil {
+			return &QuantityParseError{
+				Message: "Cannot convert project limit to quantity",
+				Err:     err,
+			}
+		}
 	}
 
-	// ServicesNodePorts
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.ServicesNodePorts, project.Spec.ResourceQuota.Limit.ServicesNodePorts, project.Spec.ResourceQuota.UsedLimit.ServicesNodePorts); err != nil {
-		errors = append(errors, fmt.Errorf("ServicesNodePorts limit: %w", err))
+	if used := *field.Value(prjUsed); used != "" {
+		if _, err := resource.ParseQuantity(used); err != nil {
+			return &QuantityParseError{
+				Message: "Cannot convert project used quota to quantity",
+				Err:     err,
+			}
+		}
 	}
 
-	// ServicesLoadBalancers
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.ServicesLoadBalancers, project.Spec.ResourceQuota.Limit.ServicesLoadBalancers, project.Spec.ResourceQuota.UsedLimit.ServicesLoadBalancers); err != nil {
-		errors = append(errors, fmt.Errorf("ServicesLoadBalancers limit: %w", err))
-	}
+	return nil
+}
 
-	// RequestsCPU
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.RequestsCPU, project.Spec.ResourceQuota.Limit.RequestsCPU, project.Spec.ResourceQuota.UsedLimit.RequestsCPU); err != nil {
-		errors = append(errors, fmt.Errorf("RequestsCPU limit: %w", err))
+// namespaceCreator returns the user the Namespace is attributed to. Rancher
+// creates the Namespaces requested through its UI using its own service
+// account, the user is recorded inside of the `field.cattle.io/creatorId`
+// annotation. The annotation is set by the requester, hence it's trusted only
+// when the request comes from Rancher: the user issuing the request is used
+// otherwise.
+func namespaceCreator(userInfo *kubewarden_protocol.UserInfo, nsMetadata *meta_v1.ObjectMeta) string {
+	if creator := nsMetadata.Annotations[RancherCreatorIDAnnotation]; creator != "" && isRancherPrincipal(userInfo) {
+		return creator
 	}
 
-	// RequestsMemory
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.RequestsMemory, project.Spec.ResourceQuota.Limit.RequestsMemory, project.Spec.ResourceQuota.UsedLimit.RequestsMemory); err != nil {
-		errors = append(errors, fmt.Errorf("RequestsMemory limit: %w", err))
-	}
+	return userInfo.Username
+}
 
-	// RequestsStorage
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.RequestsStorage, project.Spec.ResourceQuota.Limit.RequestsStorage, project.Spec.ResourceQuota.UsedLimit.RequestsStorage); err != nil {
-		errors = append(errors, fmt.Errorf("RequestsStorage limit: %w", err))
+// validateCreatorQuota ensures the resources allocated by all the Namespaces
+// of a Project created by the same user don't exceed the maximum allowed per
+// creator. The sibling Namespaces are attributed to the creator through the
+// `field.cattle.io/creatorId` annotation.
+func validateCreatorQuota(creator string, siblings []*corev1.Namespace, nsLimits, maxLimits *ResourceQuotaLimit) error {
+	if nsLimits == nil {
+		nsLimits = &ResourceQuotaLimit{}
 	}
 
-	// LimitsCPU
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.LimitsCPU, project.Spec.ResourceQuota.Limit.LimitsCPU, project.Spec.ResourceQuota.UsedLimit.LimitsCPU); err != nil {
-		errors = append(errors, fmt.Errorf("LimitsCPU limit: %w", err))
-	}
+	creatorLimits := []ResourceQuotaLimit{*nsLimits}
+	for _, sibling := range siblings {
+		if sibling.Metadata == nil || sibling.Metadata.Annotations[RancherCreatorIDAnnotation] != creator {
+			continue
+		}
 
-	// LimitsMemory
-	// nolint: staticcheck // keep k8s resources capitalized
-	if err := checkLimitVsAvailableQuota(nsLimits.LimitsMemory, project.Spec.ResourceQuota.Limit.LimitsMemory, project.Spec.ResourceQuota.UsedLimit.LimitsMemory); err != nil {
-		errors = append(errors, fmt.Errorf("LimitsMemory limit: %w", err))
-	}
+		quotaRaw, found := sibling.Metadata.Annotations[RancherResourceQuotaAnnotation]
+		if !found {
+			continue
+		}
 
-	if len(errors) == 0 {
-		return nil
+		siblingQuota := NamespaceResourceQuota{}
+		if err := json.Unmarshal([]byte(quotaRaw), &siblingQuota); err != nil {
+			return fmt.Errorf("cannot decode the %s annotation of Namespace %s: %w",
+				RancherResourceQuotaAnnotation, sibling.Metadata.Name, err)
+		}
+		creatorLimits = append(creatorLimits, siblingQuota.Limit)
 	}
 
-	errorMsgs := []string{}
-	for _, err := range errors {
-		errorMsgs = append(errorMsgs, err.Error())
+	errors := []error{}
+
+	for _, field := range resourceQuotaFields {
+		maxLimit := *field.Value(maxLimits)
+		if maxLimit == "" {
+			continue
+		}
+
+		maxLimitQuantity, err := resource.ParseQuantity(maxLimit)
+		if err != nil {
+			return fmt.Errorf("%s limit: %w", field.Name, &QuantityParseError{
+				Message: "Cannot convert maximum quota per creator to quantity",
+				Err:     err,
+			})
+		}
+
+		allocated := resource.Quantity{}
+		for _, limits := range creatorLimits {
+			limit := *field.Value(&limits)
+			if limit == "" {
+				continue
+			}
+
+			limitQuantity, err := resource.ParseQuantity(limit)
+			if err != nil {
+				return fmt.Errorf("%s limit: %w", field.Name, &QuantityParseError{
+					Message: "Cannot convert namespace limit to quantity",
+					Err:     err,
+				})
+			}
+			allocated.Add(limitQuantity)
+		}
+
+		if allocated.Cmp(maxLimitQuantity) > 0 {
+			errors = append(errors, fmt.Errorf("%s limit: %w", field.Name, &CreatorQuotaExceededError{
+				allocated: allocated.String(),
+				allowed:   maxLimitQuantity.String(),
+			}))
+		}
 	}
 
-	return fmt.Errorf("%s", strings.Join(errorMsgs, ", "))
+	return joinErrors(errors)
 }
@@ -3,6 +3,12 @@ package main
 import (
 	"strings"
 	"testing"
+
+	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
+	metav1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+	kubewarden_protocol "github.com/kubewarden/policy-sdk-go/protocol"
+
+	"github.com/kubewarden/rancher-project-quotas-namespace-validator/resource"
 )
 
 func TestCheckMalformedQuantities(t *testing.T) {
@@ -17,7 +23,7 @@ func TestCheckMalformedQuantities(t *testing.T) {
 	}
 
 	for _, tc := range cases {
-		err := checkLimitVsAvailableQuota(tc.nsLimit, tc.prjLimit, tc.prjUsed)
+		err := checkLimitVsAvailableQuota(tc.nsLimit, tc.prjLimit, tc.prjUsed, 1)
 
 		switch err := err.(type) {
 		case nil:
@@ -43,7 +49,7 @@ func TestNamespaceRequestExceedsAvailability(t *testing.T) {
 	}
 
 	for _, tc := range cases {
-		err := checkLimitVsAvailableQuota(tc.nsLimit, tc.prjLimit, tc.prjUsed)
+		err := checkLimitVsAvailableQuota(tc.nsLimit, tc.prjLimit, tc.prjUsed, 1)
 		switch err := err.(type) {
 		case nil:
 			t.Errorf("%s: should have raised an error", tc.desc)
@@ -66,7 +72,7 @@ func TestLimitIsReasonable(t *testing.T) {
 	}
 
 	for _, tc := range cases {
-		err := checkLimitVsAvailableQuota(tc.nsLimit, tc.prjLimit, tc.prjUsed)
+		err := checkLimitVsAvailableQuota(tc.nsLimit, tc.prjLimit, tc.prjUsed, 1)
 		switch err := err.(type) {
 		case nil:
 		default:
@@ -75,6 +81,30 @@ func TestLimitIsReasonable(t *testing.T) {
 	}
 }
 
+func TestOvercommitRatio(t *testing.T) {
+	cases := []struct {
+		desc                       string
+		nsLimit, prjLimit, prjUsed string
+		overcommitRatio            float64
+		expectError                bool
+	}{
+		{"Fits thanks to overcommit", "1500m", "1", "0", 2, false},
+		{"Exceeds even with overcommit", "2500m", "1", "0", 2, true},
+		{"Overcommit takes usage into account", "1500m", "1", "1", 2, true},
+		{"Reserving part of the project", "800Mi", "1Gi", "0", 0.5, true},
+	}
+
+	for _, tc := range cases {
+		err := checkLimitVsAvailableQuota(tc.nsLimit, tc.prjLimit, tc.prjUsed, tc.overcommitRatio)
+		if tc.expectError && err == nil {
+			t.Errorf("%s: should have raised an error", tc.desc)
+		}
+		if !tc.expectError && err != nil {
+			t.Errorf("%s: should not have raised an error: %v", tc.desc, err)
+		}
+	}
+}
+
 func TestValidateQuotas(t *testing.T) {
 	cases := []struct {
 		desc        string
@@ -156,8 +186,236 @@ func TestValidateQuotas(t *testing.T) {
 	}
 
 	for _, tc := range cases {
-		err := validateQuotas(tc.project, tc.nsLimits)
+		err := validateQuotas(tc.project, tc.nsLimits, nil, nil)
+
+		if !tc.expectError && err != nil {
+			t.Errorf("%s: got an unexpected error: %v", tc.desc, err)
+		}
+		if tc.expectError && err == nil {
+			t.Errorf("%s: was expecting an error", tc.desc)
+		}
+	}
+}
+
+func TestValidateQuotasMalformedProjectQuantities(t *testing.T) {
+	project := &Project{
+		Metadata: &metav1.ObjectMeta{Name: "p-abcde"},
+		Spec: &ProjectSpec{
+			ResourceQuota: &ProjectResourceQuota{
+				Limit: ResourceQuotaLimit{
+					LimitsMemory: "2GB",
+					Pods:         "10",
+				},
+				UsedLimit: ResourceQuotaLimit{
+					LimitsMemory: "1Gi",
+					Pods:         "ten",
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		desc             string
+		nsLimits         *ResourceQuotaLimit
+		malformedActions map[string]MalformedQuantityAction
+		expectError      bool
+	}{
+		{
+			"reject by default",
+			&ResourceQuotaLimit{LimitsMemory: "1Gi"},
+			nil,
+			true,
+		},
+		{
+			"explicit reject",
+			&ResourceQuotaLimit{LimitsMemory: "1Gi"},
+			map[string]MalformedQuantityAction{"limitsMemory": MalformedQuantityReject, "pods": MalformedQuantitySkip},
+			true,
+		},
+		{
+			"malformed limit treated as unlimited",
+			&ResourceQuotaLimit{LimitsMemory: "1Gi"},
+			map[string]MalformedQuantityAction{"limitsMemory": MalformedQuantityUnlimited, "pods": MalformedQuantityUnlimited},
+			false,
+		},
+		{
+			"malformed used limit skipped",
+			&ResourceQuotaLimit{Pods: "5"},
+			map[string]MalformedQuantityAction{"limitsMemory": MalformedQuantitySkip, "pods": MalformedQuantitySkip},
+			false,
+		},
+		{
+			"malformed used limit treated as zero by unlimited",
+			&ResourceQuotaLimit{Pods: "20"},
+			map[string]MalformedQuantityAction{"limitsMemory": MalformedQuantityUnlimited, "pods": MalformedQuantityUnlimited},
+			true,
+		},
+		{
+			"malformed used limit skipped whatever the request",
+			&ResourceQuotaLimit{Pods: "20"},
+			map[string]MalformedQuantityAction{"limitsMemory": MalformedQuantitySkip, "pods": MalformedQuantitySkip},
+			false,
+		},
+		{
+			"other resources are still checked",
+			&ResourceQuotaLimit{LimitsCPU: "1"},
+			map[string]MalformedQuantityAction{"limitsMemory": MalformedQuantitySkip, "pods": MalformedQuantitySkip},
+			true,
+		},
+		{
+			"malformed namespace quantity is rejected",
+			&ResourceQuotaLimit{LimitsMemory: "1GB"},
+			map[string]MalformedQuantityAction{"limitsMemory": MalformedQuantityUnlimited, "pods": MalformedQuantityUnlimited},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		err := validateQuotas(project, tc.nsLimits, nil, tc.malformedActions)
+
+		if !tc.expectError && err != nil {
+			t.Errorf("%s: got an unexpected error: %v", tc.desc, err)
+		}
+		if tc.expectError && err == nil {
+			t.Errorf("%s: was expecting an error", tc.desc)
+		}
+	}
+}
+
+func TestScaleQuantity(t *testing.T) {
+	cases := []struct {
+		quantity string
+		factor   float64
+		expected string
+	}{
+		{"1", 1.5, "1500m"},
+		{"2Gi", 0.5, "1Gi"},
+		{"1m", 0.5, "0"},
+		{"4Ei", 4, "18446744073709551616"},
+		{"9223372036854775807", 3, "27670116110564327421"},
+	}
+
+	for _, tc := range cases {
+		scaled := scaleQuantity(resource.MustParse(tc.quantity), tc.factor)
+		expected := resource.MustParse(tc.expected)
+		if scaled.Cmp(expected) != 0 {
+			t.Errorf("%s * %v: got %s instead of %s", tc.quantity, tc.factor, scaled.String(), tc.expected)
+		}
+	}
+}
+
+func TestNamespaceCreator(t *testing.T) {
+	userInfo := kubewarden_protocol.UserInfo{Username: "system:serviceaccount:cattle-system:rancher"}
+
+	nsMetadata := metav1.ObjectMeta{
+		Annotations: map[string]string{RancherCreatorIDAnnotation: "u-abcde"},
+	}
+	if creator := namespaceCreator(&userInfo, &nsMetadata); creator != "u-abcde" {
+		t.Errorf("expected the creator to be taken from the annotation, got %s", creator)
+	}
+
+	if creator := namespaceCreator(&userInfo, &metav1.ObjectMeta{}); creator != userInfo.Username {
+		t.Errorf("expected the creator to be the user issuing the request, got %s", creator)
+	}
+
+	userInfo = kubewarden_protocol.UserInfo{Username: "alice"}
+	if creator := namespaceCreator(&userInfo, &nsMetadata); creator != "alice" {
+		t.Errorf("expected the annotation set by a user to be ignored, got %s", creator)
+	}
+}
+
+func TestValidateCreatorQuota(t *testing.T) {
+	siblings := []*corev1.Namespace{
+		{
+			Metadata: &metav1.ObjectMeta{
+				Name: "alice-one",
+				Annotations: map[string]string{
+					RancherCreatorIDAnnotation:     "alice",
+					RancherResourceQuotaAnnotation: `{"limit":{"requestsCpu":"500m","pods":"10"}}`,
+				},
+			},
+		},
+		{
+			Metadata: &metav1.ObjectMeta{
+				Name: "alice-two",
+				Annotations: map[string]string{
+					RancherCreatorIDAnnotation:     "alice",
+					RancherResourceQuotaAnnotation: `{"limit":{"requestsCpu":"1"}}`,
+				},
+			},
+		},
+		{
+			Metadata: &metav1.ObjectMeta{
+				Name: "bob-one",
+				Annotations: map[string]string{
+					RancherCreatorIDAnnotation:     "bob",
+					RancherResourceQuotaAnnotation: `{"limit":{"requestsCpu":"4"}}`,
+				},
+			},
+		},
+		{
+			Metadata: &metav1.ObjectMeta{
+				Name: "no-creator",
+				Annotations: map[string]string{
+					RancherResourceQuotaAnnotation: `{"limit":{"requestsCpu":"4"}}`,
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		desc        string
+		creator     string
+		nsLimits    *ResourceQuotaLimit
+		maxLimits   *ResourceQuotaLimit
+		expectError bool
+	}{
+		{
+			"fits",
+			"alice",
+			&ResourceQuotaLimit{RequestsCPU: "500m"},
+			&ResourceQuotaLimit{RequestsCPU: "2"},
+			false,
+		},
+		{
+			"exceeds",
+			"alice",
+			&ResourceQuotaLimit{RequestsCPU: "600m"},
+			&ResourceQuotaLimit{RequestsCPU: "2"},
+			true,
+		},
+		{
+			"exceeds with a resource the namespace doesn't request",
+			"alice",
+			&ResourceQuotaLimit{RequestsCPU: "100m"},
+			&ResourceQuotaLimit{RequestsCPU: "2", Pods: "5"},
+			true,
+		},
+		{
+			"other creators are not counted",
+			"carol",
+			&ResourceQuotaLimit{RequestsCPU: "2"},
+			&ResourceQuotaLimit{RequestsCPU: "2"},
+			false,
+		},
+		{
+			"resources without maximum are not checked",
+			"alice",
+			&ResourceQuotaLimit{LimitsMemory: "100Gi"},
+			&ResourceQuotaLimit{RequestsCPU: "2"},
+			false,
+		},
+		{
+			"namespace without quota",
+			"bob",
+			nil,
+			&ResourceQuotaLimit{RequestsCPU: "2"},
+			true,
+		},
+	}
 
+	for _, tc := range cases {
+		err := validateCreatorQuota(tc.creator, siblings, tc.nsLimits, tc.maxLimits)
 		if !tc.expectError && err != nil {
 			t.Errorf("%s: got an unexpected error: %v", tc.desc, err)
 		}
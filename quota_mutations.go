@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+
+	meta_v1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+	"github.com/kubewarden/rancher-project-quotas-namespace-validator/resource"
+)
+
+// RequestedResourceQuotaAnnotation holds the `field.cattle.io/resourceQuota`
+// annotation requested by the user, before it was clamped by the policy
+const RequestedResourceQuotaAnnotation = "quotas.kubewarden.io/requested-resourceQuota"
+
+// setResourceQuotaAnnotation writes the given quota inside of the
+// `field.cattle.io/resourceQuota` annotation of the Namespace
+func setResourceQuotaAnnotation(nsMetadata *meta_v1.ObjectMeta, quota *NamespaceResourceQuota) error {
+	quotaRaw, err := json.Marshal(quota)
+	if err != nil {
+		return err
+	}
+
+	if nsMetadata.Annotations == nil {
+		nsMetadata.Annotations = map[string]string{}
+	}
+	nsMetadata.Annotations[RancherResourceQuotaAnnotation] = string(quotaRaw)
+
+	return nil
+}
+
+// mergeDefaultQuota fills the resources not limited by the Namespace with
+// the default quota of the Project. The resources set by the user are kept.
+// Returns true when the Namespace limits have been changed.
+func mergeDefaultQuota(nsLimits, defaultLimits *ResourceQuotaLimit) bool {
+	changed := false
+	for _, field := range resourceQuotaFields {
+		nsLimit := field.Value(nsLimits)
+		defaultLimit := *field.Value(defaultLimits)
+		if *nsLimit == "" && defaultLimit != "" {
+			*nsLimit = defaultLimit
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// clampQuota lowers the Namespace limits exceeding the availability of the
+// Project down to the available quota. A limit is not lowered to zero nor
+// below the given minimum: these Namespaces are left untouched, hence they
+// are rejected by the validation. Returns true when the Namespace limits
+// have been changed.
+func clampQuota(project *Project, nsLimits *ResourceQuotaLimit, overcommitRatios map[string]float64, minimum *ResourceQuotaLimit) bool {
+	if project.Spec == nil || project.Spec.ResourceQuota == nil {
+		return false
+	}
+
+	if minimum == nil {
+		minimum = &ResourceQuotaLimit{}
+	}
+
+	changed := false
+	for _, field := range resourceQuotaFields {
+		nsLimit := field.Value(nsLimits)
+		prjLimit := *field.Value(&project.Spec.ResourceQuota.Limit)
+		if *nsLimit == "" || prjLimit == "" {
+			continue
+		}
+
+		// malformed quantities are reported by the validation
+		nsLimitQuantity, err := resource.ParseQuantity(*nsLimit)
+		if err != nil {
+			continue
+		}
+
+		overcommitRatio := 1.0
+		if ratio, found := overcommitRatios[field.Key]; found {
+			overcommitRatio = ratio
+		}
+		available, err := availableQuota(prjLimit, *field.Value(&project.Spec.ResourceQuota.UsedLimit), overcommitRatio)
+		if err != nil {
+			continue
+		}
+
+		if nsLimitQuantity.Cmp(available) <= 0 || available.Sign() <= 0 {
+			continue
+		}
+
+		if minLimit := *field.Value(minimum); minLimit != "" {
+			minQuantity, err := resource.ParseQuantity(minLimit)
+			if err != nil || available.Cmp(minQuantity) < 0 {
+				continue
+			}
+		}
+
+		*nsLimit = available.String()
+		changed = true
+	}
+
+	return changed
+}
+
+// canonicalizeQuotaAnnotation rewrites the quantities of the
+// `field.cattle.io/resourceQuota` annotation to their canonical form (e.g.
+// `0.5` becomes `500m`). The resources are written in a stable order.
+// Malformed quantities are left untouched, while annotations holding unknown
+// keys are not rewritten at all to not lose them. Returns true when the
+// annotation has been changed.
+func canonicalizeQuotaAnnotation(nsMetadata *meta_v1.ObjectMeta) bool {
+	quotaRaw, found := nsMetadata.Annotations[RancherResourceQuotaAnnotation]
+	if !found {
+		return false
+	}
+
+	rawQuota := map[string]map[string]string{}
+	if err := json.Unmarshal([]byte(quotaRaw), &rawQuota); err != nil {
+		return false
+	}
+	if _, found := rawQuota["limit"]; len(rawQuota) != 1 || !found {
+		return false
+	}
+
+	quota := NamespaceResourceQuota{}
+	if err := json.Unmarshal([]byte(quotaRaw), &quota); err != nil {
+		return false
+	}
+
+	knownResources := 0
+	for _, field := range resourceQuotaFields {
+		value := field.Value(&quota.Limit)
+		if *value == "" {
+			continue
+		}
+		knownResources++
+
+		quantity, err := resource.ParseQuantity(*value)
+		if err != nil {
+			continue
+		}
+		*value = quantity.String()
+	}
+	if knownResources != len(rawQuota["limit"]) {
+		return false
+	}
+
+	canonicalRaw, err := json.Marshal(&quota)
+	if err != nil || string(canonicalRaw) == quotaRaw {
+		return false
+	}
+	nsMetadata.Annotations[RancherResourceQuotaAnnotation] = string(canonicalRaw)
+
+	return true
+}
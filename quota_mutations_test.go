@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+
+	metav1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMergeDefaultQuota(t *testing.T) {
+	nsLimits := ResourceQuotaLimit{RequestsCPU: "500m"}
+	defaultLimits := ResourceQuotaLimit{RequestsCPU: "1", LimitsMemory: "1Gi", Pods: "5"}
+
+	if !mergeDefaultQuota(&nsLimits, &defaultLimits) {
+		t.Errorf("the limits were supposed to be changed")
+	}
+	expected := ResourceQuotaLimit{RequestsCPU: "500m", LimitsMemory: "1Gi", Pods: "5"}
+	if nsLimits != expected {
+		t.Errorf("wrong limits. Got %+v instead of %+v", nsLimits, expected)
+	}
+
+	if mergeDefaultQuota(&nsLimits, &defaultLimits) {
+		t.Errorf("the limits were not supposed to be changed")
+	}
+}
+
+func TestClampQuota(t *testing.T) {
+	project := &Project{
+		Spec: &ProjectSpec{
+			ResourceQuota: &ProjectResourceQuota{
+				Limit: ResourceQuotaLimit{
+					LimitsMemory: "2Gi",
+					Pods:         "10",
+					LimitsCPU:    "1",
+				},
+				UsedLimit: ResourceQuotaLimit{
+					LimitsMemory: "1536Mi",
+					Pods:         "10",
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		desc             string
+		nsLimits         ResourceQuotaLimit
+		overcommitRatios map[string]float64
+		minimum          *ResourceQuotaLimit
+		expectedLimits   ResourceQuotaLimit
+	}{
+		{
+			"nothing to clamp",
+			ResourceQuotaLimit{LimitsMemory: "512Mi", LimitsCPU: "500m"},
+			nil,
+			nil,
+			ResourceQuotaLimit{LimitsMemory: "512Mi", LimitsCPU: "500m"},
+		},
+		{
+			"oversized limits are clamped",
+			ResourceQuotaLimit{LimitsMemory: "1Gi", LimitsCPU: "2"},
+			nil,
+			nil,
+			ResourceQuotaLimit{LimitsMemory: "512Mi", LimitsCPU: "1"},
+		},
+		{
+			"overcommit ratio is applied",
+			ResourceQuotaLimit{LimitsCPU: "2"},
+			map[string]float64{"limitsCpu": 1.5},
+			nil,
+			ResourceQuotaLimit{LimitsCPU: "1500m"},
+		},
+		{
+			"nothing available",
+			ResourceQuotaLimit{Pods: "2"},
+			nil,
+			nil,
+			ResourceQuotaLimit{Pods: "2"},
+		},
+		{
+			"availability below the minimum",
+			ResourceQuotaLimit{LimitsMemory: "1Gi", LimitsCPU: "2"},
+			nil,
+			&ResourceQuotaLimit{LimitsMemory: "768Mi", LimitsCPU: "1"},
+			ResourceQuotaLimit{LimitsMemory: "1Gi", LimitsCPU: "1"},
+		},
+		{
+			"resource not limited by the project",
+			ResourceQuotaLimit{ServicesNodePorts: "2"},
+			nil,
+			nil,
+			ResourceQuotaLimit{ServicesNodePorts: "2"},
+		},
+		{
+			"malformed namespace limit",
+			ResourceQuotaLimit{LimitsMemory: "1GB"},
+			nil,
+			nil,
+			ResourceQuotaLimit{LimitsMemory: "1GB"},
+		},
+	}
+
+	for _, tc := range cases {
+		nsLimits := tc.nsLimits
+		changed := clampQuota(project, &nsLimits, tc.overcommitRatios, tc.minimum)
+		if nsLimits != tc.expectedLimits {
+			t.Errorf("%s: wrong limits. Got %+v instead of %+v", tc.desc, nsLimits, tc.expectedLimits)
+		}
+		if changed != (tc.nsLimits != tc.expectedLimits) {
+			t.Errorf("%s: wrong changed flag: %v", tc.desc, changed)
+		}
+	}
+}
+
+func TestCanonicalizeQuotaAnnotation(t *testing.T) {
+	cases := []struct {
+		desc          string
+		quota         string
+		expectedQuota string
+	}{
+		{
+			"already canonical",
+			`{"limit":{"pods":"10","limitsCpu":"500m"}}`,
+			`{"limit":{"pods":"10","limitsCpu":"500m"}}`,
+		},
+		{
+			"quantities rewritten",
+			`{"limit":{"limitsCpu":"0.5","requestsMemory":"0.5Gi","pods":"1e1"}}`,
+			`{"limit":{"pods":"10","requestsMemory":"512Mi","limitsCpu":"500m"}}`,
+		},
+		{
+			"keys sorted",
+			`{"limit":{"limitsCpu":"500m","pods":"10"}}`,
+			`{"limit":{"pods":"10","limitsCpu":"500m"}}`,
+		},
+		{
+			"malformed quantity kept",
+			`{"limit":{"limitsMemory":"2GB","limitsCpu":"0.5"}}`,
+			`{"limit":{"limitsCpu":"500m","limitsMemory":"2GB"}}`,
+		},
+		{
+			"unknown resource",
+			`{"limit":{"limitsCpu":"0.5","requestsGpu":"1"}}`,
+			`{"limit":{"limitsCpu":"0.5","requestsGpu":"1"}}`,
+		},
+		{
+			"unknown key",
+			`{"limit":{"limitsCpu":"0.5"},"usedLimit":{"limitsCpu":"0.1"}}`,
+			`{"limit":{"limitsCpu":"0.5"},"usedLimit":{"limitsCpu":"0.1"}}`,
+		},
+		{
+			"not a quota",
+			`not json`,
+			`not json`,
+		},
+	}
+
+	for _, tc := range cases {
+		nsMetadata := metav1.ObjectMeta{
+			Annotations: map[string]string{RancherResourceQuotaAnnotation: tc.quota},
+		}
+
+		changed := canonicalizeQuotaAnnotation(&nsMetadata)
+		if quota := nsMetadata.Annotations[RancherResourceQuotaAnnotation]; quota != tc.expectedQuota {
+			t.Errorf("%s: wrong quota. Got '%s' instead of '%s'", tc.desc, quota, tc.expectedQuota)
+		}
+		if changed != (tc.quota != tc.expectedQuota) {
+			t.Errorf("%s: wrong changed flag: %v", tc.desc, changed)
+		}
+	}
+}
@@ -1,9 +1,303 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
 	kubewarden "github.com/kubewarden/policy-sdk-go"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/kubernetes"
+	kubewarden_protocol "github.com/kubewarden/policy-sdk-go/protocol"
+	"github.com/kubewarden/rancher-project-quotas-namespace-validator/resource"
 )
 
+// ConfigMapSettingsKey is the key of the ConfigMap data holding the settings,
+// written as a JSON object
+const ConfigMapSettingsKey = "settings"
+
+// NewSettingsFromValidationReq builds the Settings instance embedded inside
+// of the given ValidationRequest
+func NewSettingsFromValidationReq(validationReq *kubewarden_protocol.ValidationRequest) (Settings, error) {
+	settings := Settings{}
+	if len(validationReq.Settings) == 0 {
+		return settings, nil
+	}
+
+	err := json.Unmarshal(validationReq.Settings, &settings)
+	return settings, err
+}
+
+// Valid returns an error when the settings are not valid
+func (s *Settings) Valid() error {
+	if s.MaxNamespacesPerProject < 0 {
+		return fmt.Errorf("maxNamespacesPerProject cannot be negative")
+	}
+
+	if s.ClusterName != "" {
+		if err := checkDNS1123Label(s.ClusterName); err != nil {
+			return fmt.Errorf("clusterName: %w", err)
+		}
+	}
+
+	if s.ResolveProjectFromLabel && s.ClusterName == "" {
+		return fmt.Errorf("resolveProjectFromLabel requires clusterName to be set")
+	}
+
+	if err := s.OrphanResourceQuota.Valid(); err != nil {
+		return fmt.Errorf("orphanResourceQuota: %w", err)
+	}
+
+	if err := s.MissingProjectQuota.Valid(); err != nil {
+		return fmt.Errorf("missingProjectQuota: %w", err)
+	}
+
+	if s.ProjectIDRemoval != nil {
+		if err := s.ProjectIDRemoval.Valid(); err != nil {
+			return fmt.Errorf("projectIdRemoval: %w", err)
+		}
+	}
+
+	if s.ResourceQuotaChange != nil {
+		if err := s.ResourceQuotaChange.Valid(); err != nil {
+			return fmt.Errorf("resourceQuotaChange: %w", err)
+		}
+	}
+
+	if s.SystemProjectPrincipals != nil {
+		if err := s.SystemProjectPrincipals.Valid(); err != nil {
+			return fmt.Errorf("systemProjectPrincipals: %w", err)
+		}
+	}
+
+	if s.MaxQuotaPerCreator != nil {
+		if err := validateQuantities(s.MaxQuotaPerCreator); err != nil {
+			return fmt.Errorf("maxQuotaPerCreator: %w", err)
+		}
+	}
+
+	if s.ClampQuota != nil && s.ClampQuota.Minimum != nil {
+		if err := validateQuantities(s.ClampQuota.Minimum); err != nil {
+			return fmt.Errorf("clampQuota: minimum: %w", err)
+		}
+	}
+
+	if s.ClusterCapacity != nil {
+		if s.ClusterName == "" {
+			return fmt.Errorf("clusterCapacity requires clusterName to be set")
+		}
+		if s.ClusterCapacity.OvercommitFactor < 0 {
+			return fmt.Errorf("clusterCapacity: overcommitFactor cannot be negative")
+		}
+	}
+
+	if s.ConfigMap != "" {
+		if _, _, err := parseConfigMapReference(s.ConfigMap); err != nil {
+			return fmt.Errorf("configMap: %w", err)
+		}
+	}
+
+	for key, ratio := range s.OvercommitRatios {
+		if _, found := findResourceQuotaField(key); !found {
+			return fmt.Errorf("overcommitRatios: unknown resource '%s'", key)
+		}
+		if ratio <= 0 {
+			return fmt.Errorf("overcommitRatios: '%s': ratio must be greater than zero", key)
+		}
+	}
+
+	for key, action := range s.MalformedProjectQuantities {
+		if _, found := findResourceQuotaField(key); !found {
+			return fmt.Errorf("malformedProjectQuantities: unknown resource '%s'", key)
+		}
+		if err := action.Valid(); err != nil {
+			return fmt.Errorf("malformedProjectQuantities: '%s': %w", key, err)
+		}
+	}
+
+	for projectKey, override := range s.ProjectOverrides {
+		if _, _, err := parseProjectIDAnnotation(projectKey); err != nil {
+			return fmt.Errorf("projectOverrides: invalid key '%s': %w", projectKey, err)
+		}
+
+		if override.MaxNamespaces != nil && *override.MaxNamespaces < 0 {
+			return fmt.Errorf("projectOverrides: '%s': maxNamespaces cannot be negative", projectKey)
+		}
+	}
+
+	return nil
+}
+
+// Valid returns an error when the Action is not known. An empty Action is
+// valid, it's treated as ActionAccept.
+func (a Action) Valid() error {
+	switch a {
+	case "", ActionAccept, ActionReject, ActionLog:
+		return nil
+	default:
+		return fmt.Errorf("'%s' is not one of '%s', '%s', '%s'", a, ActionAccept, ActionReject, ActionLog)
+	}
+}
+
+// Valid returns an error when the MalformedQuantityAction is not known. An
+// empty MalformedQuantityAction is valid, it's treated as MalformedQuantityReject.
+func (a MalformedQuantityAction) Valid() error {
+	switch a {
+	case "", MalformedQuantityReject, MalformedQuantityUnlimited, MalformedQuantitySkip:
+		return nil
+	default:
+		return fmt.Errorf("'%s' is not one of '%s', '%s', '%s'", a,
+			MalformedQuantityReject, MalformedQuantityUnlimited, MalformedQuantitySkip)
+	}
+}
+
+// Valid returns an error when the SubjectAccessReview of the
+// PrivilegedOperation is not complete
+func (p *PrivilegedOperation) Valid() error {
+	if p.ResourceAttributes == nil {
+		return nil
+	}
+
+	if p.ResourceAttributes.Verb == "" {
+		return fmt.Errorf("resourceAttributes: verb cannot be empty")
+	}
+	if p.ResourceAttributes.Resource == "" {
+		return fmt.Errorf("resourceAttributes: resource cannot be empty")
+	}
+
+	return nil
+}
+
+// validateQuantities returns an error when one of the given limits cannot be
+// parsed
+func validateQuantities(limits *ResourceQuotaLimit) error {
+	for _, field := range resourceQuotaFields {
+		value := *field.Value(limits)
+		if value == "" {
+			continue
+		}
+		if _, err := resource.ParseQuantity(value); err != nil {
+			return fmt.Errorf("%s: %w", field.Key, err)
+		}
+	}
+
+	return nil
+}
+
+// MaxNamespaces returns the maximum number of Namespaces the given Project
+// can hold. Zero means there's no limit.
+func (s *Settings) MaxNamespaces(projectKey string) int {
+	if override, found := s.ProjectOverrides[projectKey]; found && override.MaxNamespaces != nil {
+		return *override.MaxNamespaces
+	}
+
+	return s.MaxNamespacesPerProject
+}
+
+// IsNamespaceExempt returns true when the given Namespace is not subject
+// to any check
+func (s *Settings) IsNamespaceExempt(name string) bool {
+	for _, exempt := range s.ExemptNamespaces {
+		if exempt == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseConfigMapReference splits a `<namespace>/<name>` ConfigMap reference
+func parseConfigMapReference(reference string) (namespace, name string, err error) {
+	chunks := strings.Split(reference, "/")
+	if len(chunks) != 2 || chunks[0] == "" || chunks[1] == "" {
+		err = fmt.Errorf("'%s' is not in the `<namespace>/<name>` format", reference)
+		return
+	}
+
+	return chunks[0], chunks[1], nil
+}
+
+// mergeConfigMapSettings fetches the ConfigMap referenced by the settings
+// and merges its contents over them. The resulting settings are validated.
+// A missing ConfigMap leaves the settings untouched, while the failures to
+// fetch it and the invalid settings are reported: the policy doesn't guess
+// the rules to enforce.
+func mergeConfigMapSettings(settings *Settings) *LookupError {
+	namespace, name, err := parseConfigMapReference(settings.ConfigMap)
+	if err != nil {
+		return &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Invalid configMap setting: %v", err)),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	getCmReq := kubernetes.GetResourceRequest{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       name,
+		Namespace:  &namespace,
+	}
+
+	configMapRaw, err := kubernetes.GetResource(&host, getCmReq)
+	if err != nil {
+		return &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Error retrieving the settings ConfigMap: %v", err)),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	if len(configMapRaw) == 0 {
+		logWarning(fmt.Sprintf("Settings ConfigMap %s not found: using the policy settings", settings.ConfigMap))
+		return nil
+	}
+
+	configMap := corev1.ConfigMap{}
+	if err := json.Unmarshal(configMapRaw, &configMap); err != nil {
+		return &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Cannot decode ConfigMap object: %s", err.Error())),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	settingsRaw, found := configMap.Data[ConfigMapSettingsKey]
+	if !found {
+		return nil
+	}
+
+	configMapReference := settings.ConfigMap
+	if err := json.Unmarshal([]byte(settingsRaw), settings); err != nil {
+		return &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Cannot decode the settings of ConfigMap %s: %s", configMapReference, err.Error())),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+	if settings.ConfigMap != configMapReference {
+		return &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("The settings of ConfigMap %s cannot change the configMap setting", configMapReference)),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	if err := settings.Valid(); err != nil {
+		return &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("The settings of ConfigMap %s are not valid: %v", configMapReference, err)),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	return nil
+}
+
 func validateSettings(payload []byte) ([]byte, error) {
+	settings := Settings{}
+	if err := json.Unmarshal(payload, &settings); err != nil {
+		return kubewarden.RejectSettings(
+			kubewarden.Message(fmt.Sprintf("Provided settings are not valid: %v", err)))
+	}
+
+	if err := settings.Valid(); err != nil {
+		return kubewarden.RejectSettings(
+			kubewarden.Message(fmt.Sprintf("Provided settings are not valid: %v", err)))
+	}
+
 	return kubewarden.AcceptSettings()
 }
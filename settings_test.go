@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/kubernetes"
+	"github.com/kubewarden/policy-sdk-go/pkg/capabilities/mocks"
+	kubewarden_protocol "github.com/kubewarden/policy-sdk-go/protocol"
+)
+
+func TestValidateSettings(t *testing.T) {
+	cases := []struct {
+		desc     string
+		settings string
+		isValid  bool
+	}{
+		{
+			"empty settings",
+			`{}`,
+			true,
+		},
+		{
+			"max namespaces",
+			`{"maxNamespacesPerProject": 10}`,
+			true,
+		},
+		{
+			"negative max namespaces",
+			`{"maxNamespacesPerProject": -1}`,
+			false,
+		},
+		{
+			"overcommit ratios",
+			`{"overcommitRatios": {"limitsCpu": 1.5, "pods": 2}}`,
+			true,
+		},
+		{
+			"overcommit ratio of unknown resource",
+			`{"overcommitRatios": {"gpus": 2}}`,
+			false,
+		},
+		{
+			"overcommit ratio not positive",
+			`{"overcommitRatios": {"limitsCpu": 0}}`,
+			false,
+		},
+		{
+			"project override",
+			`{"projectOverrides": {"local:p-abcde": {"maxNamespaces": 2}}}`,
+			true,
+		},
+		{
+			"project override with a wrong key",
+			`{"projectOverrides": {"p-abcde": {"maxNamespaces": 2}}}`,
+			false,
+		},
+		{
+			"project override with negative max namespaces",
+			`{"projectOverrides": {"local:p-abcde": {"maxNamespaces": -2}}}`,
+			false,
+		},
+		{
+			"resolve project from label",
+			`{"resolveProjectFromLabel": true, "clusterName": "local"}`,
+			true,
+		},
+		{
+			"resolve project from label without cluster name",
+			`{"resolveProjectFromLabel": true}`,
+			false,
+		},
+		{
+			"malformed project quantities",
+			`{"malformedProjectQuantities": {"limitsMemory": "skip", "pods": "unlimited", "limitsCpu": "reject"}}`,
+			true,
+		},
+		{
+			"malformed project quantities with unknown resource",
+			`{"malformedProjectQuantities": {"gpus": "skip"}}`,
+			false,
+		},
+		{
+			"malformed project quantities with unknown action",
+			`{"malformedProjectQuantities": {"pods": "ignore"}}`,
+			false,
+		},
+		{
+			"clamp quota",
+			`{"clampQuota": {"minimum": {"limitsMemory": "256Mi"}}}`,
+			true,
+		},
+		{
+			"clamp quota with malformed minimum",
+			`{"clampQuota": {"minimum": {"limitsMemory": "256MB"}}}`,
+			false,
+		},
+		{
+			"cluster capacity",
+			`{"clusterCapacity": {"overcommitFactor": 1.5}, "clusterName": "local"}`,
+			true,
+		},
+		{
+			"cluster capacity without cluster name",
+			`{"clusterCapacity": {}}`,
+			false,
+		},
+		{
+			"cluster capacity with negative overcommit factor",
+			`{"clusterCapacity": {"overcommitFactor": -1}, "clusterName": "local"}`,
+			false,
+		},
+		{
+			"orphan resource quota action",
+			`{"orphanResourceQuota": "log"}`,
+			true,
+		},
+		{
+			"unknown orphan resource quota action",
+			`{"orphanResourceQuota": "ignore"}`,
+			false,
+		},
+		{
+			"project ID removal restricted to a group",
+			`{"projectIdRemoval": {"groups": ["platform-admins"]}}`,
+			true,
+		},
+		{
+			"project ID removal restricted by a SubjectAccessReview",
+			`{"projectIdRemoval": {"resourceAttributes": {"verb": "update", "group": "management.cattle.io", "resource": "projects"}}}`,
+			true,
+		},
+		{
+			"project ID removal SubjectAccessReview without verb",
+			`{"projectIdRemoval": {"resourceAttributes": {"resource": "projects"}}}`,
+			false,
+		},
+		{
+			"max quota per creator",
+			`{"maxQuotaPerCreator": {"requestsCpu": "2", "limitsMemory": "4Gi"}}`,
+			true,
+		},
+		{
+			"max quota per creator with a malformed quantity",
+			`{"maxQuotaPerCreator": {"limitsMemory": "4GB"}}`,
+			false,
+		},
+		{
+			"configMap reference",
+			`{"configMap": "kubewarden/quotas"}`,
+			true,
+		},
+		{
+			"configMap reference without namespace",
+			`{"configMap": "quotas"}`,
+			false,
+		},
+		{
+			"not a JSON object",
+			`[]`,
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		responsePayload, err := validateSettings([]byte(tc.settings))
+		if err != nil {
+			t.Errorf("%s - unexpected error: %+v", tc.desc, err)
+		}
+
+		var response kubewarden_protocol.SettingsValidationResponse
+		if err := json.Unmarshal(responsePayload, &response); err != nil {
+			t.Errorf("%s - unexpected error: %+v", tc.desc, err)
+		}
+
+		if response.Valid != tc.isValid {
+			message := "no message set"
+			if response.Message != nil {
+				message = *response.Message
+			}
+			t.Errorf("%s - expected valid to be %v, got %v: %s", tc.desc, tc.isValid, response.Valid, message)
+		}
+	}
+}
+
+func TestMergeConfigMapSettings(t *testing.T) {
+	cases := []struct {
+		desc          string
+		data          map[string]string
+		expectError   bool
+		maxNamespaces int
+		exempt        []string
+	}{
+		{
+			"no settings inside of the ConfigMap",
+			map[string]string{},
+			false,
+			5,
+			[]string{"kube-system"},
+		},
+		{
+			"ConfigMap settings take precedence",
+			map[string]string{
+				ConfigMapSettingsKey: `{"maxNamespacesPerProject": 10, "exemptNamespaces": ["team-a"], "overcommitRatios": {"pods": 2}}`,
+			},
+			false,
+			10,
+			[]string{"team-a"},
+		},
+		{
+			"ConfigMap settings are not valid",
+			map[string]string{
+				ConfigMapSettingsKey: `{"maxNamespacesPerProject": -10}`,
+			},
+			true,
+			0,
+			nil,
+		},
+		{
+			"ConfigMap settings are not JSON",
+			map[string]string{
+				ConfigMapSettingsKey: `maxNamespacesPerProject: 10`,
+			},
+			true,
+			0,
+			nil,
+		},
+		{
+			"ConfigMap settings reference another ConfigMap",
+			map[string]string{
+				ConfigMapSettingsKey: `{"configMap": "default/other"}`,
+			},
+			true,
+			0,
+			nil,
+		},
+	}
+
+	for _, tc := range cases {
+		settings := Settings{
+			MaxNamespacesPerProject: 5,
+			OvercommitRatios:        map[string]float64{"limitsCpu": 1.5},
+			ExemptNamespaces:        []string{"kube-system"},
+			ConfigMap:               "kubewarden/quotas",
+		}
+
+		cmNamespace := "kubewarden"
+		request, err := json.Marshal(&kubernetes.GetResourceRequest{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Name:       "quotas",
+			Namespace:  &cmNamespace,
+		})
+		if err != nil {
+			t.Errorf("cannot marshall request: %v", err)
+		}
+
+		wapcResponse, err := json.Marshal(&corev1.ConfigMap{Data: tc.data})
+		if err != nil {
+			t.Errorf("cannot marshall ConfigMap: %v", err)
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		mockWapcClient.On("HostCall", "kubewarden", "kubernetes", "get_resource", request).Return(wapcResponse, nil)
+		host.Client = mockWapcClient
+
+		lookupErr := mergeConfigMapSettings(&settings)
+		if tc.expectError {
+			if lookupErr == nil {
+				t.Errorf("%s - was expecting an error", tc.desc)
+			}
+			continue
+		}
+		if lookupErr != nil {
+			t.Errorf("%s - unexpected error: %v", tc.desc, lookupErr)
+			continue
+		}
+
+		if settings.MaxNamespacesPerProject != tc.maxNamespaces {
+			t.Errorf("%s - wrong maxNamespacesPerProject. Got %d instead of %d", tc.desc, settings.MaxNamespacesPerProject, tc.maxNamespaces)
+		}
+		if settings.OvercommitRatios["limitsCpu"] != 1.5 {
+			t.Errorf("%s - the static overcommit ratios have been lost: %v", tc.desc, settings.OvercommitRatios)
+		}
+		if len(settings.ExemptNamespaces) != len(tc.exempt) || settings.ExemptNamespaces[0] != tc.exempt[0] {
+			t.Errorf("%s - wrong exemptNamespaces. Got %v instead of %v", tc.desc, settings.ExemptNamespaces, tc.exempt)
+		}
+	}
+}
+
+func TestMissingSettingsConfigMap(t *testing.T) {
+	settings := Settings{
+		MaxNamespacesPerProject: 5,
+		ConfigMap:               "kubewarden/quotas",
+	}
+
+	cmNamespace := "kubewarden"
+	request, err := json.Marshal(&kubernetes.GetResourceRequest{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Name:       "quotas",
+		Namespace:  &cmNamespace,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshall request: %v", err)
+	}
+
+	mockWapcClient := &mocks.MockWapcClient{}
+	mockWapcClient.On("HostCall", "kubewarden", "kubernetes", "get_resource", request).Return([]byte{}, nil)
+	host.Client = mockWapcClient
+
+	if lookupErr := mergeConfigMapSettings(&settings); lookupErr != nil {
+		t.Fatalf("expected the policy settings to be used, got: %v", lookupErr)
+	}
+	if settings.MaxNamespacesPerProject != 5 {
+		t.Errorf("the policy settings have been changed: %+v", settings)
+	}
+}
@@ -12,8 +12,183 @@ import (
 	apimachinery_pkg_apis_meta_v1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
 )
 
-// Settings is a an empty struct because this policy has no configuration
+// Settings holds the configuration of the policy
 type Settings struct {
+	// MaxNamespacesPerProject is the maximum number of Namespaces that can
+	// belong to a single Project. Zero means there's no limit.
+	MaxNamespacesPerProject int `json:"maxNamespacesPerProject,omitempty"`
+
+	// OvercommitRatios allows Namespaces to request more resources than the
+	// ones defined by the Project limits. The key is the name of the resource
+	// as written inside of the `field.cattle.io/resourceQuota` annotation (e.g.
+	// `limitsCpu`), the value is the factor applied to the Project limit.
+	OvercommitRatios map[string]float64 `json:"overcommitRatios,omitempty"`
+
+	// MalformedProjectQuantities defines, per resource, how the malformed
+	// quantities of the Project are handled when validating a Namespace.
+	// The key is the name of the resource as written inside of the
+	// `field.cattle.io/resourceQuota` annotation. Defaults to
+	// MalformedQuantityReject.
+	MalformedProjectQuantities map[string]MalformedQuantityAction `json:"malformedProjectQuantities,omitempty"`
+
+	// ProjectOverrides holds per-Project settings. The key is the Project
+	// identifier, using the same `<cluster>:<project>` format of the
+	// `field.cattle.io/projectId` annotation.
+	ProjectOverrides map[string]ProjectOverride `json:"projectOverrides,omitempty"`
+
+	// ClusterName is the name of the Rancher cluster the policy is running
+	// on (e.g. `local` or `c-m-abcde123`). When set, Namespaces associated
+	// to Projects of other clusters are rejected.
+	ClusterName string `json:"clusterName,omitempty"`
+
+	// StrictProjectID requires the Project ID found inside of the
+	// `field.cattle.io/projectId` annotation to have the `p-xxxxx` format
+	// of the IDs generated by Rancher
+	StrictProjectID bool `json:"strictProjectId,omitempty"`
+
+	// SyncProjectIDLabel turns on the mutation of the `field.cattle.io/projectId`
+	// label. When the label doesn't match the Project ID of the
+	// `field.cattle.io/projectId` annotation, the label is rewritten instead
+	// of rejecting the Namespace.
+	SyncProjectIDLabel bool `json:"syncProjectIdLabel,omitempty"`
+
+	// InjectDefaultQuota turns on the mutation of the Namespaces that don't
+	// have the `field.cattle.io/resourceQuota` annotation. The annotation is
+	// written from the `namespaceDefaultResourceQuota` of the Project, then
+	// the Namespace is validated.
+	InjectDefaultQuota bool `json:"injectDefaultQuota,omitempty"`
+
+	// MergeDefaultQuota turns on the mutation of the Namespaces whose
+	// `field.cattle.io/resourceQuota` annotation limits only some of the
+	// resources. The missing resources are taken from the
+	// `namespaceDefaultResourceQuota` of the Project, then the Namespace is
+	// validated.
+	MergeDefaultQuota bool `json:"mergeDefaultQuota,omitempty"`
+
+	// ClampQuota turns on the mutation of the Namespaces requesting more
+	// resources than the ones available inside of the Project. The oversized
+	// limits are lowered to the available quota, the original quota is kept
+	// inside of the `quotas.kubewarden.io/requested-resourceQuota` annotation.
+	ClampQuota *QuotaClamping `json:"clampQuota,omitempty"`
+
+	// CanonicalizeQuota turns on the mutation of the quantities of the
+	// `field.cattle.io/resourceQuota` annotation, which are rewritten in
+	// their canonical form (e.g. `0.5` becomes `500m`)
+	CanonicalizeQuota bool `json:"canonicalizeQuota,omitempty"`
+
+	// ResolveProjectFromLabel enforces the checks also against the Namespaces
+	// that are associated to a Project only through the
+	// `field.cattle.io/projectId` label. The Project is looked up inside of
+	// the cluster defined by ClusterName.
+	ResolveProjectFromLabel bool `json:"resolveProjectFromLabel,omitempty"`
+
+	// OrphanResourceQuota defines how Namespaces that have the
+	// `field.cattle.io/resourceQuota` annotation, but are not associated to
+	// any Project, are handled. Defaults to ActionAccept.
+	OrphanResourceQuota Action `json:"orphanResourceQuota,omitempty"`
+
+	// MissingProjectQuota defines how Namespaces that have the
+	// `field.cattle.io/resourceQuota` annotation, but belong to a Project
+	// without resource quota, are handled. Defaults to ActionAccept.
+	MissingProjectQuota Action `json:"missingProjectQuota,omitempty"`
+
+	// CheckProjectPermissions ensures the user creating the Namespace is
+	// allowed to manage the Namespaces of the target Project
+	CheckProjectPermissions bool `json:"checkProjectPermissions,omitempty"`
+
+	// ProjectIDRemoval restricts the removal of the `field.cattle.io/projectId`
+	// annotation from existing Namespaces, which would take them out of their
+	// Project quota. When not set, the removal is allowed to everybody.
+	ProjectIDRemoval *PrivilegedOperation `json:"projectIdRemoval,omitempty"`
+
+	// ResourceQuotaChange restricts the changes of the
+	// `field.cattle.io/resourceQuota` annotation of existing Namespaces.
+	// When not set, the changes are allowed to everybody.
+	ResourceQuotaChange *PrivilegedOperation `json:"resourceQuotaChange,omitempty"`
+
+	// ProtectSystemProject prevents Namespaces from being added to the
+	// Rancher System Project by principals other than the Kubernetes system
+	// ones (control plane components, service accounts of `kube-system` and
+	// `cattle-system`, members of `system:masters`)
+	ProtectSystemProject bool `json:"protectSystemProject,omitempty"`
+
+	// SystemProjectPrincipals are the additional principals allowed to add
+	// Namespaces to the Rancher System Project
+	SystemProjectPrincipals *PrivilegedOperation `json:"systemProjectPrincipals,omitempty"`
+
+	// MaxQuotaPerCreator is the maximum amount of resources the Namespaces
+	// created by the same user can allocate inside of a single Project.
+	// The Namespaces are attributed to their creator through the
+	// `field.cattle.io/creatorId` annotation.
+	MaxQuotaPerCreator *ResourceQuotaLimit `json:"maxQuotaPerCreator,omitempty"`
+
+	// ClusterCapacity turns on the check of the Project quotas against the
+	// allocatable resources of the Nodes. Requires ClusterName to be set.
+	ClusterCapacity *ClusterCapacityCheck `json:"clusterCapacity,omitempty"`
+
+	// ExemptNamespaces is the list of Namespaces that are not subject to
+	// any check
+	ExemptNamespaces []string `json:"exemptNamespaces,omitempty"`
+
+	// ConfigMap is the `<namespace>/<name>` reference of a ConfigMap that
+	// holds additional settings. These are merged over the other settings
+	// at admission time.
+	ConfigMap string `json:"configMap,omitempty"`
+}
+
+// Action defines how the policy reacts to a questionable Namespace
+type Action string
+
+const (
+	// ActionAccept accepts the Namespace
+	ActionAccept Action = "accept"
+	// ActionReject rejects the Namespace
+	ActionReject Action = "reject"
+	// ActionLog accepts the Namespace, writing a warning inside of the logs
+	ActionLog Action = "log"
+)
+
+// MalformedQuantityAction defines how a malformed quantity of a Project is handled
+type MalformedQuantityAction string
+
+const (
+	// MalformedQuantityReject rejects the Namespace
+	MalformedQuantityReject MalformedQuantityAction = "reject"
+	// MalformedQuantityUnlimited considers the resource as not limited by
+	// the Project when its limit is malformed. A malformed used limit is
+	// considered as zero: the Namespace must fit inside of the Project limit.
+	MalformedQuantityUnlimited MalformedQuantityAction = "unlimited"
+	// MalformedQuantitySkip skips the check of the resource whenever one of
+	// its Project quantities is malformed, writing a warning inside of the
+	// logs
+	MalformedQuantitySkip MalformedQuantityAction = "skip"
+)
+
+// LogEvent is a log message sent to the host
+type LogEvent struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+}
+
+// ProjectOverride holds the settings that can be overridden on a per-Project basis
+type ProjectOverride struct {
+	// MaxNamespaces overrides Settings.MaxNamespacesPerProject
+	MaxNamespaces *int `json:"maxNamespaces,omitempty"`
+}
+
+// QuotaClamping configures the clamping of the Namespace quotas
+type QuotaClamping struct {
+	// Minimum is the lowest limit a resource can be clamped to. When less
+	// than the minimum is available the Namespace is rejected.
+	Minimum *ResourceQuotaLimit `json:"minimum,omitempty"`
+}
+
+// ClusterCapacityCheck configures the check of the Project quotas against
+// the capacity of the cluster
+type ClusterCapacityCheck struct {
+	// OvercommitFactor is applied to the allocatable resources of the
+	// Nodes. Zero means no overcommitment.
+	OvercommitFactor float64 `json:"overcommitFactor,omitempty"`
 }
 
 // ConditionStatus is a valid condition status
@@ -145,3 +320,29 @@ type MonitoringCondition struct {
 	// Human-readable message indicating details about last transition
 	Message string `json:"message,omitempty"`
 }
+
+// PrivilegedOperation defines who is allowed to perform an operation
+// protected by the policy. The operation is allowed when the user is part
+// of the allow-lists or passes the SubjectAccessReview.
+type PrivilegedOperation struct {
+	// Users allowed to perform the operation
+	Users []string `json:"users,omitempty"`
+	// Groups whose members are allowed to perform the operation
+	Groups []string `json:"groups,omitempty"`
+	// ResourceAttributes of the SubjectAccessReview the user must pass to
+	// perform the operation
+	ResourceAttributes *ResourceAttributes `json:"resourceAttributes,omitempty"`
+}
+
+// ResourceAttributes describes the action being checked by a
+// SubjectAccessReview
+type ResourceAttributes struct {
+	// Namespace is the namespace of the action being requested
+	Namespace string `json:"namespace"`
+	// Verb is a kubernetes resource API verb, like: get, list, create
+	Verb string `json:"verb"`
+	// Group is the API Group of the Resource
+	Group string `json:"group"`
+	// Resource is one of the existing resource types
+	Resource string `json:"resource"`
+}
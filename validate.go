@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strings"
+	"unicode"
 
 	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
 	meta_v1 "github.com/kubewarden/k8s-objects/apimachinery/pkg/apis/meta/v1"
@@ -24,6 +25,15 @@ const (
 	// Namespace
 	RancherResourceQuotaAnnotation = "field.cattle.io/resourceQuota"
 
+	// RancherProjectIDLabel is the label used by Rancher Manager inside of
+	// Namespace object. The value is the ID of the Project the Namespace
+	// belongs to, without the cluster prefix
+	RancherProjectIDLabel = "field.cattle.io/projectId"
+
+	// RancherCreatorIDAnnotation is the annotation used by Rancher Manager
+	// inside of Namespace object to track the user who created it
+	RancherCreatorIDAnnotation = "field.cattle.io/creatorId"
+
 	// RancherProjectAPIVersion is the Kubernetes Group + Version used by the Project resources
 	RancherProjectAPIVersion = "management.cattle.io/v3"
 
@@ -31,6 +41,13 @@ const (
 	RancherProjectKind = "Project"
 )
 
+// projectReadinessConditions are the Project conditions that must not be
+// failing for Namespaces to be added to the Project
+var projectReadinessConditions = []string{
+	"BackingNamespaceCreated",
+	"InitialRolesPopulated",
+}
+
 var host = capabilities.NewHost()
 
 func validate(payload []byte) ([]byte, error) {
@@ -43,6 +60,23 @@ func validate(payload []byte) ([]byte, error) {
 			kubewarden.Code(400))
 	}
 
+	settings, err := NewSettingsFromValidationReq(&validationRequest)
+	if err != nil {
+		return kubewarden.RejectRequest(
+			kubewarden.Message(
+				fmt.Sprintf("Cannot decode settings: %s", err.Error())),
+			kubewarden.Code(400))
+	}
+
+	if validationRequest.Request.Kind.Kind == RancherProjectKind {
+		return validateProjectRequest(&validationRequest, &settings)
+	}
+
+	return validateNamespaceRequest(&validationRequest, &settings)
+}
+
+// validateNamespaceRequest validates the creation and the update of Namespaces
+func validateNamespaceRequest(validationRequest *kubewarden_protocol.ValidationRequest, settings *Settings) ([]byte, error) {
 	// Access the **raw** JSON that describes the object
 	namespaceJSON := validationRequest.Request.Object
 
@@ -56,16 +90,92 @@ func validate(payload []byte) ([]byte, error) {
 			kubewarden.Code(400))
 	}
 
-	nsMetadata := &meta_v1.ObjectMeta{}
-	if namespace.Metadata != nil {
-		nsMetadata = namespace.Metadata
+	if namespace.Metadata == nil {
+		namespace.Metadata = &meta_v1.ObjectMeta{}
+	}
+	nsMetadata := namespace.Metadata
+
+	isUpdate := validationRequest.Request.Operation == "UPDATE"
+	oldNsMetadata := &meta_v1.ObjectMeta{}
+	if isUpdate {
+		oldNamespace := &corev1.Namespace{}
+		if err := json.Unmarshal([]byte(validationRequest.Request.OldObject), oldNamespace); err != nil {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(
+					fmt.Sprintf("Cannot decode old Namespace object: %s", err.Error())),
+				kubewarden.Code(400))
+		}
+		if oldNamespace.Metadata != nil {
+			oldNsMetadata = oldNamespace.Metadata
+		}
+	}
+
+	projectIDAnnotation, annotationFound := nsMetadata.Annotations[RancherProjectIDAnnotation]
+	projectIDLabel, labelFound := nsMetadata.Labels[RancherProjectIDLabel]
+	nsResourceQuotaRaw, resourceQuotaFound := nsMetadata.Annotations[RancherResourceQuotaAnnotation]
+	_, oldAnnotationFound := oldNsMetadata.Annotations[RancherProjectIDAnnotation]
+	_, oldResourceQuotaFound := oldNsMetadata.Annotations[RancherResourceQuotaAnnotation]
+	if !annotationFound && !labelFound && !resourceQuotaFound && !oldAnnotationFound && !oldResourceQuotaFound {
+		return kubewarden.AcceptRequest()
+	}
+
+	if settings.ConfigMap != "" {
+		if lookupError := mergeConfigMapSettings(settings); lookupError != nil {
+			return kubewarden.RejectRequest(
+				lookupError.Message,
+				lookupError.StatusCode)
+		}
 	}
 
-	projectIDAnnotation, found := nsMetadata.Annotations[RancherProjectIDAnnotation]
-	if !found {
+	if settings.IsNamespaceExempt(nsMetadata.Name) {
 		return kubewarden.AcceptRequest()
 	}
 
+	if isUpdate {
+		if lookupError := checkNamespaceUpdate(settings, &validationRequest.Request.UserInfo, oldNsMetadata, nsMetadata); lookupError != nil {
+			return kubewarden.RejectRequest(
+				lookupError.Message,
+				lookupError.StatusCode)
+		}
+
+		// The quotas are checked only when the Namespace joins a Project,
+		// like it happens on creation. A new label must still match the
+		// annotation.
+		if !projectAssociationChanged(settings, oldNsMetadata, nsMetadata) {
+			mutated := false
+			if projectIDLabelChanged(oldNsMetadata, nsMetadata) && annotationFound {
+				if _, projectID, err := parseProjectIDAnnotation(projectIDAnnotation); err == nil {
+					mutated, err = checkProjectIDLabel(settings, nsMetadata, projectID)
+					if err != nil {
+						return kubewarden.RejectRequest(
+							kubewarden.Message(err.Error()),
+							kubewarden.NoCode)
+					}
+				}
+			}
+			return acceptNamespace(settings, namespace, mutated)
+		}
+	}
+
+	if !annotationFound {
+		if !settings.ResolveProjectFromLabel || !labelFound {
+			if resourceQuotaFound {
+				message := fmt.Sprintf("Namespace %s has the %s annotation, but it's not associated to any Project: the quota is ignored by Rancher",
+					nsMetadata.Name, RancherResourceQuotaAnnotation)
+				if applyAction(settings.OrphanResourceQuota, message) {
+					return kubewarden.RejectRequest(
+						kubewarden.Message(message),
+						kubewarden.NoCode)
+				}
+			}
+			return acceptNamespace(settings, namespace, false)
+		}
+
+		// The Namespace is associated to the Project only through the label,
+		// the Project belongs to the cluster the policy is running on
+		projectIDAnnotation = fmt.Sprintf("%s:%s", settings.ClusterName, projectIDLabel)
+	}
+
 	projectNamespace, projectID, err := parseProjectIDAnnotation(projectIDAnnotation)
 	if err != nil {
 		return kubewarden.RejectRequest(
@@ -73,9 +183,35 @@ func validate(payload []byte) ([]byte, error) {
 			kubewarden.Code(400))
 	}
 
+	if settings.StrictProjectID {
+		if err := checkRancherProjectIDFormat(projectID); err != nil {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(err.Error()),
+				kubewarden.Code(400))
+		}
+	}
+
+	// `<cluster>:<project>` identifier of the Project, the Namespace might
+	// be associated to it only through the label
+	projectKey := fmt.Sprintf("%s:%s", projectNamespace, projectID)
+
+	mutated, err := checkProjectIDLabel(settings, nsMetadata, projectID)
+	if err != nil {
+		return kubewarden.RejectRequest(
+			kubewarden.Message(err.Error()),
+			kubewarden.NoCode)
+	}
+
+	if settings.ClusterName != "" && projectNamespace != settings.ClusterName {
+		return kubewarden.RejectRequest(
+			kubewarden.Message(
+				fmt.Sprintf("Project %s belongs to cluster '%s', while this is cluster '%s'",
+					projectKey, projectNamespace, settings.ClusterName)),
+			kubewarden.NoCode)
+	}
+
 	nsResourceQuota := NamespaceResourceQuota{}
-	nsResourceQuotaRaw, found := nsMetadata.Annotations[RancherResourceQuotaAnnotation]
-	if found {
+	if resourceQuotaFound {
 		if err := json.Unmarshal([]byte(nsResourceQuotaRaw), &nsResourceQuota); err != nil {
 			return kubewarden.RejectRequest(
 				kubewarden.Message(
@@ -91,16 +227,203 @@ func validate(payload []byte) ([]byte, error) {
 			lookupError.StatusCode)
 	}
 
-	validationErr := validateQuotas(&project, &nsResourceQuota.Limit)
+	if project.Spec != nil && project.Spec.ClusterName != "" && project.Spec.ClusterName != projectNamespace {
+		return kubewarden.RejectRequest(
+			kubewarden.Message(
+				fmt.Sprintf("The cluster '%s' referenced by the %s annotation doesn't match the cluster '%s' of the Project",
+					projectNamespace, RancherProjectIDAnnotation, project.Spec.ClusterName)),
+			kubewarden.NoCode)
+	}
+
+	if err := checkProjectIsReady(&project); err != nil {
+		return kubewarden.RejectRequest(
+			kubewarden.Message(fmt.Sprintf("Project %s cannot hold new namespaces: %s", projectKey, err.Error())),
+			kubewarden.NoCode)
+	}
+
+	if settings.ProtectSystemProject {
+		if lookupError := checkSystemProjectAccess(settings, &validationRequest.Request.UserInfo, &project, projectKey); lookupError != nil {
+			return kubewarden.RejectRequest(
+				lookupError.Message,
+				lookupError.StatusCode)
+		}
+	}
+
+	if settings.CheckProjectPermissions {
+		if lookupError := checkProjectPermissions(&validationRequest.Request.UserInfo, projectNamespace, projectID); lookupError != nil {
+			return kubewarden.RejectRequest(
+				lookupError.Message,
+				lookupError.StatusCode)
+		}
+	}
+
+	prjPolicy, err := newProjectPolicy(settings, projectKey, &project)
+	if err != nil {
+		return kubewarden.RejectRequest(
+			kubewarden.Message(err.Error()),
+			kubewarden.NoCode)
+	}
+
+	if prjPolicy.enforcementDisabled {
+		return acceptNamespace(settings, namespace, mutated)
+	}
+
+	// Rancher would later apply the default quota of the Project to the
+	// Namespace, the quota is injected right away to validate it.
+	// `nsResourceQuotaRaw` keeps the quota requested by the user.
+	defaultQuotaInjected := false
+	if project.Spec != nil && project.Spec.ResourceQuota != nil && project.Spec.NamespaceDefaultResourceQuota != nil {
+		quotaChanged := false
+		switch {
+		case !resourceQuotaFound && settings.InjectDefaultQuota:
+			nsResourceQuota = *project.Spec.NamespaceDefaultResourceQuota
+			quotaChanged = true
+			defaultQuotaInjected = true
+		case resourceQuotaFound && settings.MergeDefaultQuota:
+			quotaChanged = mergeDefaultQuota(&nsResourceQuota.Limit, &project.Spec.NamespaceDefaultResourceQuota.Limit)
+		}
+
+		if quotaChanged {
+			if err := setResourceQuotaAnnotation(nsMetadata, &nsResourceQuota); err != nil {
+				return kubewarden.RejectRequest(
+					kubewarden.Message(
+						fmt.Sprintf("Cannot write the %s annotation: %s", RancherResourceQuotaAnnotation, err.Error())),
+					kubewarden.Code(500))
+			}
+			mutated = true
+		}
+	}
+
+	if settings.ClampQuota != nil && (resourceQuotaFound || defaultQuotaInjected) {
+		if clampQuota(&project, &nsResourceQuota.Limit, prjPolicy.overcommitRatios, settings.ClampQuota.Minimum) {
+			if err := setResourceQuotaAnnotation(nsMetadata, &nsResourceQuota); err != nil {
+				return kubewarden.RejectRequest(
+					kubewarden.Message(
+						fmt.Sprintf("Cannot write the %s annotation: %s", RancherResourceQuotaAnnotation, err.Error())),
+					kubewarden.Code(500))
+			}
+			// there's nothing to record when the user didn't request any
+			// quota, the one clamped is the default quota of the Project
+			if resourceQuotaFound {
+				nsMetadata.Annotations[RequestedResourceQuotaAnnotation] = nsResourceQuotaRaw
+			}
+			mutated = true
+		}
+	}
+
+	siblings := []*corev1.Namespace{}
+	if prjPolicy.maxNamespaces > 0 || settings.MaxQuotaPerCreator != nil {
+		var lookupError *LookupError
+		siblings, lookupError = listProjectNamespaces(projectID, nsMetadata.Name)
+		if lookupError != nil {
+			return kubewarden.RejectRequest(
+				lookupError.Message,
+				lookupError.StatusCode)
+		}
+	}
+
+	if prjPolicy.maxNamespaces > 0 {
+		if len(siblings) >= prjPolicy.maxNamespaces {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(
+					fmt.Sprintf("Project %s already contains %d namespaces, the maximum allowed is %d",
+						projectKey, len(siblings), prjPolicy.maxNamespaces)),
+				kubewarden.NoCode)
+		}
+	}
+
+	if resourceQuotaFound && (project.Spec == nil || project.Spec.ResourceQuota == nil) {
+		message := fmt.Sprintf("Namespace %s has the %s annotation, but Project %s doesn't define any resource quota: Rancher doesn't create a ResourceQuota for the Namespace",
+			nsMetadata.Name, RancherResourceQuotaAnnotation, projectKey)
+		if applyAction(settings.MissingProjectQuota, message) {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(message),
+				kubewarden.NoCode)
+		}
+	}
+
+	validationErr := validateQuotas(&project, &nsResourceQuota.Limit, prjPolicy.overcommitRatios, settings.MalformedProjectQuantities)
 	if validationErr != nil {
 		return kubewarden.RejectRequest(
 			kubewarden.Message(validationErr.Error()),
 			kubewarden.NoCode)
 	}
 
+	if settings.MaxQuotaPerCreator != nil {
+		creator := namespaceCreator(&validationRequest.Request.UserInfo, nsMetadata)
+		if err := validateCreatorQuota(creator, siblings, &nsResourceQuota.Limit, settings.MaxQuotaPerCreator); err != nil {
+			return kubewarden.RejectRequest(
+				kubewarden.Message(fmt.Sprintf("User %s exceeds the quota allowed per creator inside of Project %s: %s",
+					creator, projectKey, err.Error())),
+				kubewarden.NoCode)
+		}
+
+		// record the creator, the following Namespaces of the Project are
+		// checked against it
+		if nsMetadata.Annotations[RancherCreatorIDAnnotation] != creator {
+			if nsMetadata.Annotations == nil {
+				nsMetadata.Annotations = map[string]string{}
+			}
+			nsMetadata.Annotations[RancherCreatorIDAnnotation] = creator
+			mutated = true
+		}
+	}
+
+	return acceptNamespace(settings, namespace, mutated)
+}
+
+// checkProjectIDLabel ensures the `field.cattle.io/projectId` label of the
+// Namespace matches the given Project ID. When the `syncProjectIdLabel`
+// setting is enabled the label is rewritten instead, returning true.
+func checkProjectIDLabel(settings *Settings, nsMetadata *meta_v1.ObjectMeta, projectID string) (bool, error) {
+	projectIDLabel, labelFound := nsMetadata.Labels[RancherProjectIDLabel]
+	if labelFound && projectIDLabel == projectID {
+		return false, nil
+	}
+
+	switch {
+	case settings.SyncProjectIDLabel:
+		if nsMetadata.Labels == nil {
+			nsMetadata.Labels = map[string]string{}
+		}
+		nsMetadata.Labels[RancherProjectIDLabel] = projectID
+		return true, nil
+	case labelFound:
+		return false, fmt.Errorf("The %s label '%s' doesn't match the Project ID '%s' of the %s annotation",
+			RancherProjectIDLabel, projectIDLabel, projectID, RancherProjectIDAnnotation)
+	}
+
+	return false, nil
+}
+
+// acceptNamespace accepts the request, the Namespace is returned as mutated
+// object when it has been changed by the policy
+func acceptNamespace(settings *Settings, namespace *corev1.Namespace, mutated bool) ([]byte, error) {
+	if settings.CanonicalizeQuota && canonicalizeQuotaAnnotation(namespace.Metadata) {
+		mutated = true
+	}
+
+	if mutated {
+		return kubewarden.MutateRequest(namespace)
+	}
+
 	return kubewarden.AcceptRequest()
 }
 
+// applyAction returns true when the given Action requires the request to be
+// rejected. The message is logged when the Action is ActionLog.
+func applyAction(action Action, message string) bool {
+	switch action {
+	case ActionReject:
+		return true
+	case ActionLog:
+		logWarning(message)
+		return false
+	default:
+		return false
+	}
+}
+
 // LookupError is a custom error that provides extra information
 type LookupError struct {
 	StatusCode kubewarden.Code
@@ -147,7 +470,78 @@ func findProject(projectID, projectNamespace string) (Project, *LookupError) {
 	return project, nil
 }
 
+// checkProjectIsReady returns an error when the Project is being deleted or
+// when one of its readiness conditions is failing
+func checkProjectIsReady(project *Project) error {
+	if project.Metadata != nil && project.Metadata.DeletionTimestamp != nil {
+		return fmt.Errorf("the project is being deleted")
+	}
+
+	for _, condition := range project.Status.Conditions {
+		if condition.Status != ConditionFalse {
+			continue
+		}
+
+		for _, readinessCondition := range projectReadinessConditions {
+			if condition.Type == readinessCondition {
+				return fmt.Errorf("condition %s is %s: reason '%s', message '%s'",
+					condition.Type, condition.Status, condition.Reason, condition.Message)
+			}
+		}
+	}
+
+	return nil
+}
+
+// listProjectNamespaces returns all the Namespaces that belong to the given
+// Project, excluding the one named `skipName`
+func listProjectNamespaces(projectID, skipName string) ([]*corev1.Namespace, *LookupError) {
+	labelSelector := fmt.Sprintf("%s=%s", RancherProjectIDLabel, projectID)
+
+	listNsReq := kubernetes.ListAllResourcesRequest{
+		APIVersion:    "v1",
+		Kind:          "Namespace",
+		LabelSelector: &labelSelector,
+	}
+
+	namespacesRaw, err := kubernetes.ListResources(&host, listNsReq)
+	if err != nil {
+		return nil, &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Error listing the Namespaces of the Project: %v", err)),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	namespaceList := corev1.NamespaceList{}
+	if err := json.Unmarshal(namespacesRaw, &namespaceList); err != nil {
+		return nil, &LookupError{
+			Message:    kubewarden.Message(fmt.Sprintf("Cannot decode NamespaceList object: %s", err.Error())),
+			StatusCode: kubewarden.Code(500),
+		}
+	}
+
+	namespaces := []*corev1.Namespace{}
+	for _, ns := range namespaceList.Items {
+		if ns == nil || (ns.Metadata != nil && ns.Metadata.Name == skipName) {
+			continue
+		}
+		namespaces = append(namespaces, ns)
+	}
+
+	return namespaces, nil
+}
+
+// parseProjectIDAnnotation parses the value of the `field.cattle.io/projectId`
+// annotation. The value is made of the name of the cluster and the ID of the
+// Project, separated by a colon (e.g. `local:p-abcde`).
+//
+// Both the cluster name and the Project ID must be valid DNS-1123 labels.
 func parseProjectIDAnnotation(annotation string) (projectNamespace string, projectID string, err error) {
+	if strings.IndexFunc(annotation, unicode.IsSpace) >= 0 {
+		err = fmt.Errorf("cannot parse projectID annotation '%s': whitespace is not allowed", annotation)
+		return
+	}
+
 	chunks := strings.Split(annotation, ":")
 	if len(chunks) != 2 {
 		err = fmt.Errorf("cannot parse projectID annotation: wrong format")
@@ -164,5 +558,56 @@ func parseProjectIDAnnotation(annotation string) (projectNamespace string, proje
 		return
 	}
 
+	if labelErr := checkDNS1123Label(chunks[0]); labelErr != nil {
+		err = fmt.Errorf("cluster name '%s' is not valid: %w", chunks[0], labelErr)
+		return
+	}
+
+	if labelErr := checkDNS1123Label(chunks[1]); labelErr != nil {
+		err = fmt.Errorf("Project ID '%s' is not valid: %w", chunks[1], labelErr)
+		return
+	}
+
 	return chunks[0], chunks[1], nil
 }
+
+// checkRancherProjectIDFormat ensures the Project ID has the `p-xxxxx` shape
+// of the IDs generated by Rancher
+func checkRancherProjectIDFormat(projectID string) error {
+	suffix := strings.TrimPrefix(projectID, "p-")
+	if suffix == projectID || suffix == "" {
+		return fmt.Errorf("Project ID '%s' doesn't have the Rancher `p-xxxxx` format", projectID)
+	}
+
+	for _, c := range suffix {
+		if !isLowerAlphaNumeric(c) {
+			return fmt.Errorf("Project ID '%s' doesn't have the Rancher `p-xxxxx` format", projectID)
+		}
+	}
+
+	return nil
+}
+
+// checkDNS1123Label returns an error when the value is not a valid
+// DNS-1123 label, as defined by RFC 1123
+func checkDNS1123Label(value string) error {
+	if len(value) > 63 {
+		return fmt.Errorf("must be no more than 63 characters")
+	}
+
+	for i, c := range value {
+		if isLowerAlphaNumeric(c) {
+			continue
+		}
+		if c == '-' && i != 0 && i != len(value)-1 {
+			continue
+		}
+		return fmt.Errorf("must consist of lower case alphanumeric characters or '-', and must start and end with an alphanumeric character")
+	}
+
+	return nil
+}
+
+func isLowerAlphaNumeric(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+}
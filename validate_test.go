@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 
 	corev1 "github.com/kubewarden/k8s-objects/api/core/v1"
@@ -235,6 +236,81 @@ func TestFindProject(t *testing.T) {
 	}
 }
 
+func TestCheckProjectIsReady(t *testing.T) {
+	deletionTimestamp := metav1.Time{}
+
+	cases := []struct {
+		desc        string
+		project     Project
+		expectError bool
+	}{
+		{
+			"no conditions",
+			Project{Spec: &ProjectSpec{}},
+			false,
+		},
+		{
+			"all conditions are fine",
+			Project{
+				Spec: &ProjectSpec{},
+				Status: ProjectStatus{
+					Conditions: []ProjectCondition{
+						{Type: "BackingNamespaceCreated", Status: ConditionTrue},
+						{Type: "InitialRolesPopulated", Status: ConditionUnknown},
+					},
+				},
+			},
+			false,
+		},
+		{
+			"being deleted",
+			Project{
+				Metadata: &metav1.ObjectMeta{
+					Name:              "p-abcde",
+					DeletionTimestamp: &deletionTimestamp,
+				},
+				Spec: &ProjectSpec{},
+			},
+			true,
+		},
+		{
+			"readiness condition failed",
+			Project{
+				Spec: &ProjectSpec{},
+				Status: ProjectStatus{
+					Conditions: []ProjectCondition{
+						{Type: "BackingNamespaceCreated", Status: ConditionTrue},
+						{Type: "InitialRolesPopulated", Status: ConditionFalse, Reason: "Error", Message: "something went wrong"},
+					},
+				},
+			},
+			true,
+		},
+		{
+			"unrelated condition failed",
+			Project{
+				Spec: &ProjectSpec{},
+				Status: ProjectStatus{
+					Conditions: []ProjectCondition{
+						{Type: "MonitoringEnabled", Status: ConditionFalse},
+					},
+				},
+			},
+			false,
+		},
+	}
+
+	for _, tc := range cases {
+		err := checkProjectIsReady(&tc.project)
+		if tc.expectError && err == nil {
+			t.Errorf("%s - was expecting an error", tc.desc)
+		}
+		if !tc.expectError && err != nil {
+			t.Errorf("%s - unexpected error: %v", tc.desc, err)
+		}
+	}
+}
+
 func TestParseProjectAnnotation(t *testing.T) {
 	cases := []struct {
 		desc        string
@@ -273,11 +349,60 @@ func TestParseProjectAnnotation(t *testing.T) {
 		},
 		{
 			"all good",
-			"NS:ID",
-			"NS",
-			"ID",
+			"ns:id",
+			"ns",
+			"id",
 			false,
 		},
+		{
+			"underscore separator",
+			"c-abcde_p-abcde",
+			"",
+			"",
+			true,
+		},
+		{
+			"whitespace",
+			"local:p abcde",
+			"",
+			"",
+			true,
+		},
+		{
+			"trailing newline",
+			"local:p-abcde\n",
+			"",
+			"",
+			true,
+		},
+		{
+			"upper case cluster name",
+			"Local:p-abcde",
+			"",
+			"",
+			true,
+		},
+		{
+			"upper case project ID",
+			"local:P-ABCDE",
+			"",
+			"",
+			true,
+		},
+		{
+			"project ID ending with a dash",
+			"local:p-",
+			"",
+			"",
+			true,
+		},
+		{
+			"project ID too long",
+			"local:p-" + strings.Repeat("a", 62),
+			"",
+			"",
+			true,
+		},
 	}
 
 	for _, tc := range cases {
@@ -301,3 +426,1052 @@ func TestParseProjectAnnotation(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxNamespacesPerProject(t *testing.T) {
+	cases := []struct {
+		desc       string
+		settings   Settings
+		siblings   []string
+		isValid    bool
+		listCalled bool
+	}{
+		{
+			"no limit",
+			Settings{},
+			[]string{"one", "two"},
+			true,
+			false,
+		},
+		{
+			"below the limit",
+			Settings{MaxNamespacesPerProject: 3},
+			[]string{"one", "two"},
+			true,
+			true,
+		},
+		{
+			"limit reached",
+			Settings{MaxNamespacesPerProject: 2},
+			[]string{"one", "two"},
+			false,
+			true,
+		},
+		{
+			"the namespace being validated is not counted",
+			Settings{MaxNamespacesPerProject: 2},
+			[]string{"one", "test-ns"},
+			true,
+			true,
+		},
+		{
+			"per-project override",
+			Settings{
+				MaxNamespacesPerProject: 2,
+				ProjectOverrides: map[string]ProjectOverride{
+					"proj-ns:proj-id": {MaxNamespaces: intPtr(5)},
+				},
+			},
+			[]string{"one", "two"},
+			true,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		projectID := "proj-id"
+		projectNs := "proj-ns"
+
+		namespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name: "test-ns",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation: fmt.Sprintf("%s:%s", projectNs, projectID),
+				},
+			},
+		}
+
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:      projectID,
+				Namespace: projectNs,
+			},
+			Spec: &ProjectSpec{
+				DisplayName: "a project",
+			},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		mockProjectLookup(t, mockWapcClient, &project)
+		mockNamespaceList(t, mockWapcClient, projectID, tc.siblings)
+		host.Client = mockWapcClient
+
+		payload, err := kubewarden_testing.BuildValidationRequest(&namespace, &tc.settings)
+		if err != nil {
+			t.Errorf("Unexpected error: %+v", err)
+		}
+
+		responsePayload, err := validate(payload)
+		if err != nil {
+			t.Errorf("Unexpected error: %+v", err)
+		}
+
+		var response kubewarden_protocol.ValidationResponse
+		if err := json.Unmarshal(responsePayload, &response); err != nil {
+			t.Errorf("Unexpected error: %+v", err)
+		}
+
+		if response.Accepted != tc.isValid {
+			t.Errorf("%s - expected accepted to be %v, got %v", tc.desc, tc.isValid, response.Accepted)
+		}
+
+		listCalled := false
+		for _, call := range mockWapcClient.Calls {
+			if call.Arguments.Get(2) == "list_resources_all" {
+				listCalled = true
+			}
+		}
+		if listCalled != tc.listCalled {
+			t.Errorf("%s - expected the Namespaces to be listed: %v", tc.desc, tc.listCalled)
+		}
+	}
+}
+
+func TestCreatorQuotaAttribution(t *testing.T) {
+	cases := []struct {
+		desc            string
+		username        string
+		creatorID       string
+		isValid         bool
+		expectedCreator string
+	}{
+		{
+			"quota of the requester exceeded",
+			"alice",
+			"",
+			false,
+			"",
+		},
+		{
+			"requester spoofing another creator",
+			"alice",
+			"bob",
+			false,
+			"",
+		},
+		{
+			"creator set by Rancher",
+			"system:serviceaccount:cattle-system:rancher",
+			"bob",
+			true,
+			"",
+		},
+		{
+			"creator recorded",
+			"bob",
+			"",
+			true,
+			"bob",
+		},
+	}
+
+	for _, tc := range cases {
+		namespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name: "test-ns",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation:     "proj-ns:proj-id",
+					RancherResourceQuotaAnnotation: `{"limit":{"limitsMemory":"1Gi"}}`,
+				},
+			},
+		}
+		if tc.creatorID != "" {
+			namespace.Metadata.Annotations[RancherCreatorIDAnnotation] = tc.creatorID
+		}
+
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:      "proj-id",
+				Namespace: "proj-ns",
+			},
+			Spec: &ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					Limit:     ResourceQuotaLimit{LimitsMemory: "10Gi"},
+					UsedLimit: ResourceQuotaLimit{LimitsMemory: "1Gi"},
+				},
+			},
+		}
+
+		siblings := []*corev1.Namespace{
+			{
+				Metadata: &metav1.ObjectMeta{
+					Name: "alice-one",
+					Annotations: map[string]string{
+						RancherCreatorIDAnnotation:     "alice",
+						RancherResourceQuotaAnnotation: `{"limit":{"limitsMemory":"1Gi"}}`,
+					},
+				},
+			},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		mockProjectLookup(t, mockWapcClient, &project)
+		mockNamespaceListItems(t, mockWapcClient, "proj-id", siblings)
+		host.Client = mockWapcClient
+
+		settings := Settings{MaxQuotaPerCreator: &ResourceQuotaLimit{LimitsMemory: "1536Mi"}}
+		userInfo := kubewarden_protocol.UserInfo{Username: tc.username}
+		response := runValidation(t, "CREATE", namespaceKind, &namespace, nil, &userInfo, &settings)
+		if response.Accepted != tc.isValid {
+			t.Errorf("%s - expected accepted to be %v, got %v", tc.desc, tc.isValid, response.Accepted)
+		}
+
+		mutatedNamespace := mutatedNamespace(t, &response)
+		if tc.expectedCreator == "" {
+			if mutatedNamespace != nil {
+				t.Errorf("%s - the namespace was not supposed to be mutated", tc.desc)
+			}
+			continue
+		}
+
+		if mutatedNamespace == nil {
+			t.Errorf("%s - the namespace was supposed to be mutated", tc.desc)
+			continue
+		}
+		if creator := mutatedNamespace.Metadata.Annotations[RancherCreatorIDAnnotation]; creator != tc.expectedCreator {
+			t.Errorf("%s - wrong creator. Got '%s' instead of '%s'", tc.desc, creator, tc.expectedCreator)
+		}
+	}
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// mockProjectLookup registers the response of the `get_resource` host
+// callback used to find the given Project
+func mockProjectLookup(t *testing.T, mockWapcClient *mocks.MockWapcClient, project *Project) {
+	t.Helper()
+
+	request, err := json.Marshal(&kubernetes.GetResourceRequest{
+		APIVersion:   RancherProjectAPIVersion,
+		Kind:         RancherProjectKind,
+		Name:         project.Metadata.Name,
+		Namespace:    &project.Metadata.Namespace,
+		DisableCache: true,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshall request: %v", err)
+	}
+
+	wapcResponse, err := json.Marshal(project)
+	if err != nil {
+		t.Fatalf("cannot create mock client with a Project as payload: %v", err)
+	}
+
+	mockWapcClient.On("HostCall", "kubewarden", "kubernetes", "get_resource", request).Return(wapcResponse, nil)
+}
+
+// mockNamespaceList registers the response of the `list_resources_all` host
+// callback used to find the Namespaces of the given Project
+func mockNamespaceList(t *testing.T, mockWapcClient *mocks.MockWapcClient, projectID string, names []string) {
+	t.Helper()
+
+	namespaces := []*corev1.Namespace{}
+	for _, name := range names {
+		namespaces = append(namespaces, &corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{RancherProjectIDLabel: projectID},
+			},
+		})
+	}
+	mockNamespaceListItems(t, mockWapcClient, projectID, namespaces)
+}
+
+// mockNamespaceListItems registers the response of the `list_resources_all`
+// host callback used to find the Namespaces of the given Project
+func mockNamespaceListItems(t *testing.T, mockWapcClient *mocks.MockWapcClient, projectID string, namespaces []*corev1.Namespace) {
+	t.Helper()
+
+	labelSelector := fmt.Sprintf("%s=%s", RancherProjectIDLabel, projectID)
+	request, err := json.Marshal(&kubernetes.ListAllResourcesRequest{
+		APIVersion:    "v1",
+		Kind:          "Namespace",
+		LabelSelector: &labelSelector,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshall request: %v", err)
+	}
+
+	wapcResponse, err := json.Marshal(&corev1.NamespaceList{Items: namespaces})
+	if err != nil {
+		t.Fatalf("cannot marshall NamespaceList: %v", err)
+	}
+
+	mockWapcClient.On("HostCall", "kubewarden", "kubernetes", "list_resources_all", request).Return(wapcResponse, nil)
+}
+
+func TestClusterName(t *testing.T) {
+	cases := []struct {
+		desc               string
+		settings           Settings
+		projectClusterName string
+		isValid            bool
+	}{
+		{
+			"cluster name not set",
+			Settings{},
+			"proj-ns",
+			true,
+		},
+		{
+			"namespace of the current cluster",
+			Settings{ClusterName: "proj-ns"},
+			"proj-ns",
+			true,
+		},
+		{
+			"namespace of another cluster",
+			Settings{ClusterName: "c-m-abcde"},
+			"proj-ns",
+			false,
+		},
+		{
+			"annotation doesn't match the cluster of the project",
+			Settings{},
+			"c-m-abcde",
+			false,
+		},
+		{
+			"project without cluster name",
+			Settings{},
+			"",
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		projectID := "proj-id"
+		projectNs := "proj-ns"
+
+		namespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name: "test-ns",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation: fmt.Sprintf("%s:%s", projectNs, projectID),
+				},
+			},
+		}
+
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:      projectID,
+				Namespace: projectNs,
+			},
+			Spec: &ProjectSpec{
+				DisplayName: "a project",
+				ClusterName: tc.projectClusterName,
+			},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		mockProjectLookup(t, mockWapcClient, &project)
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "CREATE", namespaceKind, &namespace, nil, nil, &tc.settings)
+		if response.Accepted != tc.isValid {
+			t.Errorf("%s - expected accepted to be %v, got %v", tc.desc, tc.isValid, response.Accepted)
+		}
+	}
+}
+
+var (
+	namespaceKind = kubewarden_protocol.GroupVersionKind{Version: "v1", Kind: "Namespace"}
+	projectKind   = kubewarden_protocol.GroupVersionKind{Group: RancherManagementGroup, Version: "v3", Kind: RancherProjectKind}
+)
+
+// runValidation invokes the `validate` function against an admission request
+// of the given operation and kind, returning the decoded response. oldObject
+// is nil unless the operation is an UPDATE, userInfo can be nil.
+func runValidation(t *testing.T, operation string, kind kubewarden_protocol.GroupVersionKind, object, oldObject interface{}, userInfo *kubewarden_protocol.UserInfo, settings *Settings) kubewarden_protocol.ValidationResponse {
+	t.Helper()
+
+	objectRaw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatalf("cannot marshall object: %v", err)
+	}
+	oldObjectRaw, err := json.Marshal(oldObject)
+	if err != nil {
+		t.Fatalf("cannot marshall old object: %v", err)
+	}
+	settingsRaw, err := json.Marshal(settings)
+	if err != nil {
+		t.Fatalf("cannot marshall settings: %v", err)
+	}
+
+	request := kubewarden_protocol.KubernetesAdmissionRequest{
+		Kind:      kind,
+		Operation: operation,
+		Object:    objectRaw,
+		OldObject: oldObjectRaw,
+	}
+	if userInfo != nil {
+		request.UserInfo = *userInfo
+	}
+
+	payload, err := json.Marshal(&kubewarden_protocol.ValidationRequest{
+		Request:  request,
+		Settings: settingsRaw,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshall request: %v", err)
+	}
+
+	responsePayload, err := validate(payload)
+	if err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	var response kubewarden_protocol.ValidationResponse
+	if err := json.Unmarshal(responsePayload, &response); err != nil {
+		t.Fatalf("Unexpected error: %+v", err)
+	}
+
+	return response
+}
+
+func TestCheckRancherProjectIDFormat(t *testing.T) {
+	cases := []struct {
+		projectID   string
+		expectError bool
+	}{
+		{"p-abcde", false},
+		{"p-4x7k2", false},
+		{"p-", true},
+		{"abcde", true},
+		{"project-abcde", true},
+		{"p-ab-cd", true},
+	}
+
+	for _, tc := range cases {
+		err := checkRancherProjectIDFormat(tc.projectID)
+		if tc.expectError && err == nil {
+			t.Errorf("%s - was supposed to fail", tc.projectID)
+		}
+		if !tc.expectError && err != nil {
+			t.Errorf("%s - was not supposed to fail. Got this err: %v", tc.projectID, err)
+		}
+	}
+}
+
+func TestProjectIDLabel(t *testing.T) {
+	cases := []struct {
+		desc          string
+		settings      Settings
+		labels        map[string]string
+		isValid       bool
+		expectedLabel string
+	}{
+		{
+			"label matches the annotation",
+			Settings{},
+			map[string]string{RancherProjectIDLabel: "proj-id"},
+			true,
+			"",
+		},
+		{
+			"label doesn't match the annotation",
+			Settings{},
+			map[string]string{RancherProjectIDLabel: "another-proj-id"},
+			false,
+			"",
+		},
+		{
+			"label not set",
+			Settings{},
+			nil,
+			true,
+			"",
+		},
+		{
+			"label doesn't match the annotation, mutation enabled",
+			Settings{SyncProjectIDLabel: true},
+			map[string]string{RancherProjectIDLabel: "another-proj-id", "team": "a-team"},
+			true,
+			"proj-id",
+		},
+		{
+			"label not set, mutation enabled",
+			Settings{SyncProjectIDLabel: true},
+			nil,
+			true,
+			"proj-id",
+		},
+		{
+			"label matches the annotation, mutation enabled",
+			Settings{SyncProjectIDLabel: true},
+			map[string]string{RancherProjectIDLabel: "proj-id"},
+			true,
+			"",
+		},
+	}
+
+	for _, tc := range cases {
+		projectID := "proj-id"
+		projectNs := "proj-ns"
+
+		namespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name: "test-ns",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation: fmt.Sprintf("%s:%s", projectNs, projectID),
+				},
+				Labels: tc.labels,
+			},
+		}
+
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:      projectID,
+				Namespace: projectNs,
+			},
+			Spec: &ProjectSpec{
+				DisplayName: "a project",
+			},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		mockProjectLookup(t, mockWapcClient, &project)
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "CREATE", namespaceKind, &namespace, nil, nil, &tc.settings)
+		if response.Accepted != tc.isValid {
+			t.Errorf("%s - expected accepted to be %v, got %v", tc.desc, tc.isValid, response.Accepted)
+		}
+
+		mutatedNamespace := mutatedNamespace(t, &response)
+		if tc.expectedLabel == "" {
+			if mutatedNamespace != nil {
+				t.Errorf("%s - the namespace was not supposed to be mutated", tc.desc)
+			}
+			continue
+		}
+
+		if mutatedNamespace == nil {
+			t.Errorf("%s - the namespace was supposed to be mutated", tc.desc)
+			continue
+		}
+		if label := mutatedNamespace.Metadata.Labels[RancherProjectIDLabel]; label != tc.expectedLabel {
+			t.Errorf("%s - wrong label. Got '%s' instead of '%s'", tc.desc, label, tc.expectedLabel)
+		}
+		if len(mutatedNamespace.Metadata.Labels) != len(tc.labels) && len(tc.labels) != 0 {
+			t.Errorf("%s - the other labels have been lost: %v", tc.desc, mutatedNamespace.Metadata.Labels)
+		}
+	}
+}
+
+// mutatedNamespace returns the Namespace inside of the response, nil when
+// the request has not been mutated
+func mutatedNamespace(t *testing.T, response *kubewarden_protocol.ValidationResponse) *corev1.Namespace {
+	t.Helper()
+
+	if response.MutatedObject == nil {
+		return nil
+	}
+
+	mutatedObjectRaw, err := json.Marshal(response.MutatedObject)
+	if err != nil {
+		t.Fatalf("cannot marshall the mutated object: %v", err)
+	}
+
+	namespace := corev1.Namespace{}
+	if err := json.Unmarshal(mutatedObjectRaw, &namespace); err != nil {
+		t.Fatalf("cannot unmarshall the mutated object: %v", err)
+	}
+
+	return &namespace
+}
+
+func TestDefaultQuotaMutation(t *testing.T) {
+	cases := []struct {
+		desc          string
+		settings      Settings
+		nsQuota       string
+		usedLimit     string
+		isValid       bool
+		expectedQuota string
+	}{
+		{
+			"feature disabled",
+			Settings{},
+			"",
+			"",
+			true,
+			"",
+		},
+		{
+			"default quota injected",
+			Settings{InjectDefaultQuota: true},
+			"",
+			"",
+			true,
+			`{"limit":{"pods":"5","limitsMemory":"1Gi"}}`,
+		},
+		{
+			"annotation already set",
+			Settings{InjectDefaultQuota: true},
+			`{"limit":{"limitsMemory":"512Mi","pods":"2"}}`,
+			"",
+			true,
+			"",
+		},
+		{
+			"injected quota exceeds the availability",
+			Settings{InjectDefaultQuota: true},
+			"",
+			"1536Mi",
+			false,
+			"",
+		},
+		{
+			"partial quota, merge disabled",
+			Settings{InjectDefaultQuota: true},
+			`{"limit":{"pods":"2"}}`,
+			"",
+			true,
+			"",
+		},
+		{
+			"partial quota merged",
+			Settings{MergeDefaultQuota: true},
+			`{"limit":{"pods":"2"}}`,
+			"",
+			true,
+			`{"limit":{"pods":"2","limitsMemory":"1Gi"}}`,
+		},
+		{
+			"complete quota, nothing to merge",
+			Settings{MergeDefaultQuota: true},
+			`{"limit":{"pods":"2","limitsMemory":"512Mi"}}`,
+			"",
+			true,
+			"",
+		},
+		{
+			"merged quota exceeds the availability",
+			Settings{MergeDefaultQuota: true},
+			`{"limit":{"pods":"2"}}`,
+			"1536Mi",
+			false,
+			"",
+		},
+		{
+			"merge doesn't inject",
+			Settings{MergeDefaultQuota: true},
+			"",
+			"",
+			true,
+			"",
+		},
+		{
+			"quota canonicalized",
+			Settings{CanonicalizeQuota: true},
+			`{"limit":{"limitsMemory":"0.5Gi","pods":"2"}}`,
+			"",
+			true,
+			`{"limit":{"pods":"2","limitsMemory":"512Mi"}}`,
+		},
+		{
+			"canonical quota",
+			Settings{CanonicalizeQuota: true},
+			`{"limit":{"pods":"2","limitsMemory":"512Mi"}}`,
+			"",
+			true,
+			"",
+		},
+		{
+			"merged quota canonicalized",
+			Settings{MergeDefaultQuota: true, CanonicalizeQuota: true},
+			`{"limit":{"limitsMemory":"0.25Gi"}}`,
+			"",
+			true,
+			`{"limit":{"pods":"5","limitsMemory":"256Mi"}}`,
+		},
+	}
+
+	for _, tc := range cases {
+		namespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name: "test-ns",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation: "proj-ns:proj-id",
+				},
+				Labels: map[string]string{RancherProjectIDLabel: "proj-id"},
+			},
+		}
+		if tc.nsQuota != "" {
+			namespace.Metadata.Annotations[RancherResourceQuotaAnnotation] = tc.nsQuota
+		}
+
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:      "proj-id",
+				Namespace: "proj-ns",
+			},
+			Spec: &ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					Limit:     ResourceQuotaLimit{LimitsMemory: "2Gi", Pods: "10"},
+					UsedLimit: ResourceQuotaLimit{LimitsMemory: tc.usedLimit},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{LimitsMemory: "1Gi", Pods: "5"},
+				},
+			},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		mockProjectLookup(t, mockWapcClient, &project)
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "CREATE", namespaceKind, &namespace, nil, nil, &tc.settings)
+		if response.Accepted != tc.isValid {
+			message := "no message set"
+			if response.Message != nil {
+				message = *response.Message
+			}
+			t.Errorf("%s - expected accepted to be %v, got %v: %s", tc.desc, tc.isValid, response.Accepted, message)
+		}
+
+		mutatedNamespace := mutatedNamespace(t, &response)
+		if tc.expectedQuota == "" {
+			if mutatedNamespace != nil {
+				t.Errorf("%s - the namespace was not supposed to be mutated", tc.desc)
+			}
+			continue
+		}
+
+		if mutatedNamespace == nil {
+			t.Errorf("%s - the namespace was supposed to be mutated", tc.desc)
+			continue
+		}
+		if quota := mutatedNamespace.Metadata.Annotations[RancherResourceQuotaAnnotation]; quota != tc.expectedQuota {
+			t.Errorf("%s - wrong quota. Got '%s' instead of '%s'", tc.desc, quota, tc.expectedQuota)
+		}
+		if projectID := mutatedNamespace.Metadata.Annotations[RancherProjectIDAnnotation]; projectID != "proj-ns:proj-id" {
+			t.Errorf("%s - the other annotations have been lost: %v", tc.desc, mutatedNamespace.Metadata.Annotations)
+		}
+	}
+}
+
+func TestClampQuotaMutation(t *testing.T) {
+	cases := []struct {
+		desc              string
+		settings          Settings
+		nsQuota           string
+		isValid           bool
+		expectedQuota     string
+		expectedRequested string
+	}{
+		{
+			"feature disabled",
+			Settings{},
+			`{"limit":{"limitsMemory":"1Gi"}}`,
+			false,
+			"",
+			"",
+		},
+		{
+			"quota fits",
+			Settings{ClampQuota: &QuotaClamping{}},
+			`{"limit":{"limitsMemory":"512Mi"}}`,
+			true,
+			"",
+			"",
+		},
+		{
+			"quota clamped",
+			Settings{ClampQuota: &QuotaClamping{}},
+			`{"limit":{"limitsMemory":"1Gi","pods":"2"}}`,
+			true,
+			`{"limit":{"pods":"2","limitsMemory":"512Mi"}}`,
+			`{"limit":{"limitsMemory":"1Gi","pods":"2"}}`,
+		},
+		{
+			"merged quota clamped",
+			Settings{MergeDefaultQuota: true, ClampQuota: &QuotaClamping{}},
+			`{"limit":{"limitsMemory":"1Gi"}}`,
+			true,
+			`{"limit":{"pods":"1","limitsMemory":"512Mi"}}`,
+			`{"limit":{"limitsMemory":"1Gi"}}`,
+		},
+		{
+			"availability below the minimum",
+			Settings{ClampQuota: &QuotaClamping{Minimum: &ResourceQuotaLimit{LimitsMemory: "768Mi"}}},
+			`{"limit":{"limitsMemory":"1Gi"}}`,
+			false,
+			"",
+			"",
+		},
+	}
+
+	for _, tc := range cases {
+		namespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name: "test-ns",
+				Annotations: map[string]string{
+					RancherProjectIDAnnotation:     "proj-ns:proj-id",
+					RancherResourceQuotaAnnotation: tc.nsQuota,
+				},
+				Labels: map[string]string{RancherProjectIDLabel: "proj-id"},
+			},
+		}
+
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:      "proj-id",
+				Namespace: "proj-ns",
+			},
+			Spec: &ProjectSpec{
+				ResourceQuota: &ProjectResourceQuota{
+					Limit:     ResourceQuotaLimit{LimitsMemory: "2Gi", Pods: "10"},
+					UsedLimit: ResourceQuotaLimit{LimitsMemory: "1536Mi", Pods: "2"},
+				},
+				NamespaceDefaultResourceQuota: &NamespaceResourceQuota{
+					Limit: ResourceQuotaLimit{Pods: "1"},
+				},
+			},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		mockProjectLookup(t, mockWapcClient, &project)
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "CREATE", namespaceKind, &namespace, nil, nil, &tc.settings)
+		if response.Accepted != tc.isValid {
+			message := "no message set"
+			if response.Message != nil {
+				message = *response.Message
+			}
+			t.Errorf("%s - expected accepted to be %v, got %v: %s", tc.desc, tc.isValid, response.Accepted, message)
+		}
+
+		mutatedNamespace := mutatedNamespace(t, &response)
+		if tc.expectedQuota == "" {
+			if mutatedNamespace != nil {
+				t.Errorf("%s - the namespace was not supposed to be mutated", tc.desc)
+			}
+			continue
+		}
+
+		if mutatedNamespace == nil {
+			t.Errorf("%s - the namespace was supposed to be mutated", tc.desc)
+			continue
+		}
+		if quota := mutatedNamespace.Metadata.Annotations[RancherResourceQuotaAnnotation]; quota != tc.expectedQuota {
+			t.Errorf("%s - wrong quota. Got '%s' instead of '%s'", tc.desc, quota, tc.expectedQuota)
+		}
+		if requested := mutatedNamespace.Metadata.Annotations[RequestedResourceQuotaAnnotation]; requested != tc.expectedRequested {
+			t.Errorf("%s - wrong requested quota. Got '%s' instead of '%s'", tc.desc, requested, tc.expectedRequested)
+		}
+	}
+}
+
+func TestResolveProjectFromLabel(t *testing.T) {
+	cases := []struct {
+		desc     string
+		settings Settings
+		nsQuota  string
+		isValid  bool
+		lookup   bool
+	}{
+		{
+			"label only, feature disabled",
+			Settings{},
+			`{"limit":{"pods":"100"}}`,
+			true,
+			false,
+		},
+		{
+			"label only, enough quota",
+			Settings{ResolveProjectFromLabel: true, ClusterName: "proj-ns"},
+			`{"limit":{"pods":"10"}}`,
+			true,
+			true,
+		},
+		{
+			"label only, not enough quota",
+			Settings{ResolveProjectFromLabel: true, ClusterName: "proj-ns"},
+			`{"limit":{"pods":"100"}}`,
+			false,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		projectID := "proj-id"
+		projectNs := "proj-ns"
+
+		namespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name: "test-ns",
+				Annotations: map[string]string{
+					RancherResourceQuotaAnnotation: tc.nsQuota,
+				},
+				Labels: map[string]string{
+					RancherProjectIDLabel: projectID,
+				},
+			},
+		}
+
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:      projectID,
+				Namespace: projectNs,
+			},
+			Spec: &ProjectSpec{
+				DisplayName: "a project",
+				ResourceQuota: &ProjectResourceQuota{
+					Limit:     ResourceQuotaLimit{Pods: "20"},
+					UsedLimit: ResourceQuotaLimit{Pods: "5"},
+				},
+			},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		if tc.lookup {
+			mockProjectLookup(t, mockWapcClient, &project)
+		}
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "CREATE", namespaceKind, &namespace, nil, nil, &tc.settings)
+		if response.Accepted != tc.isValid {
+			t.Errorf("%s - expected accepted to be %v, got %v", tc.desc, tc.isValid, response.Accepted)
+		}
+		if tc.lookup {
+			mockWapcClient.AssertExpectations(t)
+		}
+	}
+}
+
+func TestOrphanResourceQuota(t *testing.T) {
+	cases := []struct {
+		desc        string
+		settings    Settings
+		annotations map[string]string
+		isValid     bool
+	}{
+		{
+			"default action",
+			Settings{},
+			map[string]string{RancherResourceQuotaAnnotation: `{"limit":{"pods":"10"}}`},
+			true,
+		},
+		{
+			"reject",
+			Settings{OrphanResourceQuota: ActionReject},
+			map[string]string{RancherResourceQuotaAnnotation: `{"limit":{"pods":"10"}}`},
+			false,
+		},
+		{
+			"log",
+			Settings{OrphanResourceQuota: ActionLog},
+			map[string]string{RancherResourceQuotaAnnotation: `{"limit":{"pods":"10"}}`},
+			true,
+		},
+		{
+			"no quota annotation",
+			Settings{OrphanResourceQuota: ActionReject},
+			map[string]string{"team": "a-team"},
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		namespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name:        "test-ns",
+				Annotations: tc.annotations,
+			},
+		}
+
+		// no host capability is expected to be used
+		host.Client = &mocks.MockWapcClient{}
+
+		response := runValidation(t, "CREATE", namespaceKind, &namespace, nil, nil, &tc.settings)
+		if response.Accepted != tc.isValid {
+			t.Errorf("%s - expected accepted to be %v, got %v", tc.desc, tc.isValid, response.Accepted)
+		}
+	}
+}
+
+func TestMissingProjectQuota(t *testing.T) {
+	cases := []struct {
+		desc     string
+		settings Settings
+		nsQuota  bool
+		isValid  bool
+	}{
+		{
+			"default action",
+			Settings{},
+			true,
+			true,
+		},
+		{
+			"reject",
+			Settings{MissingProjectQuota: ActionReject},
+			true,
+			false,
+		},
+		{
+			"log",
+			Settings{MissingProjectQuota: ActionLog},
+			true,
+			true,
+		},
+		{
+			"namespace without quota",
+			Settings{MissingProjectQuota: ActionReject},
+			false,
+			true,
+		},
+	}
+
+	for _, tc := range cases {
+		projectID := "proj-id"
+		projectNs := "proj-ns"
+
+		annotations := map[string]string{
+			RancherProjectIDAnnotation: fmt.Sprintf("%s:%s", projectNs, projectID),
+		}
+		if tc.nsQuota {
+			annotations[RancherResourceQuotaAnnotation] = `{"limit":{"pods":"10"}}`
+		}
+
+		namespace := corev1.Namespace{
+			Metadata: &metav1.ObjectMeta{
+				Name:        "test-ns",
+				Annotations: annotations,
+			},
+		}
+
+		project := Project{
+			Metadata: &metav1.ObjectMeta{
+				Name:      projectID,
+				Namespace: projectNs,
+			},
+			Spec: &ProjectSpec{
+				DisplayName: "a project without quota",
+			},
+		}
+
+		mockWapcClient := &mocks.MockWapcClient{}
+		mockProjectLookup(t, mockWapcClient, &project)
+		host.Client = mockWapcClient
+
+		response := runValidation(t, "CREATE", namespaceKind, &namespace, nil, nil, &tc.settings)
+		if response.Accepted != tc.isValid {
+			t.Errorf("%s - expected accepted to be %v, got %v", tc.desc, tc.isValid, response.Accepted)
+		}
+	}
+}